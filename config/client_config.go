@@ -1,23 +1,23 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"strconv"
 	"strings"
 )
 
-const (
-	// 默认最大隧道数
-	minTunnelCount = 1
-	maxTunnelCount = 10
-)
-
 // 客户端配置
 type ClientConfig struct {
-	Key         string       // 参考服务端配置
-	ServerAddr  NetAddress   // 服务端地址
-	ProxyAddrs  []NetAddress // 内网服务地址及映射端口
-	TunnelCount int          // 隧道条数(1-10)
+	Key         string          // 参考服务端配置，配置了客户端编号时为服务端客户端凭据中的密钥
+	ClientID    string          // 服务端客户端凭据中的客户端编号，为空时使用服务端密钥或者 -generate 创建的密钥
+	ServerAddr  NetAddress      // 服务端地址
+	ProxyAddrs  []NetAddress    // 内网服务地址及映射端口
+	TLS         TLSConfig       // 连接服务端的TLS配置
+	Heartbeat   HeartbeatConfig // 心跳配置
+	MetricsAddr string          // 监控指标端口监听地址，为空时不启用
+	// 监控指标访问令牌，为空时不校验，监控指标端口监听非本机地址时必须配置
+	MetricsToken string
 }
 
 var clientConfig ClientConfig
@@ -28,7 +28,7 @@ func parseClientConfig(args []string) ClientConfig {
 		log.Fatalln("参数缺失。", args)
 	}
 
-	config := ClientConfig{TunnelCount: minTunnelCount}
+	config := ClientConfig{Heartbeat: DefaultHeartbeatConfig()}
 	var ok bool
 
 	// 1 Key
@@ -41,34 +41,32 @@ func parseClientConfig(args []string) ClientConfig {
 	if config.ProxyAddrs, ok = ParseNetAddresses(strings.TrimSpace(args[2])); !ok {
 		log.Fatalln("内网服务地址及映射端口错误。", args[2])
 	}
-	// 4 TunnelCount
-	if len(args) >= 4 {
-		var err error
-		if config.TunnelCount, err = strconv.Atoi(args[3]); err != nil {
-			log.Fatalln("隧道条数错误", args[3])
-		}
-		if config.TunnelCount > maxTunnelCount {
-			config.TunnelCount = maxTunnelCount
-		}
-		if config.TunnelCount < minTunnelCount {
-			config.TunnelCount = minTunnelCount
-		}
-	}
 	return config
 }
 
 // 从配置文件中加载配置
 func loadClientConfig() ClientConfig {
+	config, err := clientConfigFromYaml(Config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return config
+}
+
+// 检查并转换配置文件中的客户端配置，格式错误的代理映射忽略
+func clientConfigFromYaml(yamlConfig *Yaml) (ClientConfig, error) {
+	client := yamlConfig.Client
 	config := ClientConfig{}
 
-	config.Key = Config.Client.Key
+	config.Key = client.Key
+	config.ClientID = strings.TrimSpace(client.ClientID)
 
 	var ok bool
-	if config.ServerAddr, ok = ParseNetAddress(Config.Client.ServerAddr); !ok {
-		log.Fatalln("服务端地址配置错误。", Config.Client.ServerAddr)
+	if config.ServerAddr, ok = ParseNetAddress(client.ServerAddr); !ok {
+		return ClientConfig{}, fmt.Errorf("服务端地址配置错误。%s", client.ServerAddr)
 	}
 
-	for _, proxyMapping := range Config.Client.ProxyMappings {
+	for _, proxyMapping := range client.ProxyMappings {
 		if proxyAddr, ok := ParseNetAddress(proxyMapping); ok {
 			config.ProxyAddrs = append(config.ProxyAddrs, proxyAddr)
 		} else {
@@ -77,18 +75,30 @@ func loadClientConfig() ClientConfig {
 	}
 
 	if len(config.ProxyAddrs) < 1 {
-		log.Fatalln("内网服务地址及映射端口配置错误。")
+		return ClientConfig{}, errors.New("内网服务地址及映射端口配置错误。")
 	}
 
-	config.TunnelCount = Config.Client.TunnelCount
-	if config.TunnelCount > maxTunnelCount {
-		config.TunnelCount = maxTunnelCount
+	config.TLS = client.TLS.toTLSConfig()
+	config.Heartbeat = client.Heartbeat.toHeartbeatConfig()
+	config.MetricsAddr = strings.TrimSpace(client.MetricsAddr)
+	config.MetricsToken = client.MetricsToken
+
+	return config, nil
+}
+
+// 重新读取配置文件中的客户端配置，配置有误时返回错误，不影响当前配置
+func ReloadClientConfig() (ClientConfig, error) {
+	yamlConfig, err := readConfigFile()
+	if err != nil {
+		return ClientConfig{}, err
 	}
-	if config.TunnelCount < minTunnelCount {
-		config.TunnelCount = minTunnelCount
+	config, err := clientConfigFromYaml(yamlConfig)
+	if err != nil {
+		return ClientConfig{}, err
 	}
-
-	return config
+	Config = yamlConfig
+	clientConfig = config
+	return config, nil
 }
 
 // 初始化客户端配置，支持从参数中读取或者从配置文件中读取
@@ -1,51 +1,246 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+type TLSYaml struct {
+	Enable             bool   `yaml:"enable"`
+	CertFile           string `yaml:"cert-file"`
+	KeyFile            string `yaml:"key-file"`
+	CAFile             string `yaml:"ca-file"`
+	ServerName         string `yaml:"server-name"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+	ClientAuth         bool   `yaml:"client-auth"`
+}
+
+func (t TLSYaml) toTLSConfig() TLSConfig {
+	return TLSConfig{
+		Enable:             t.Enable,
+		CertFile:           t.CertFile,
+		KeyFile:            t.KeyFile,
+		CAFile:             t.CAFile,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ClientAuth:         t.ClientAuth,
+	}
+}
+
+type HeartbeatYaml struct {
+	Interval     uint32 `yaml:"interval"`
+	Timeout      uint32 `yaml:"timeout"`
+	TCPKeepAlive uint32 `yaml:"tcp-keepalive"`
+}
+
+// 未配置的项使用默认值，单位为秒
+func (h HeartbeatYaml) toHeartbeatConfig() HeartbeatConfig {
+	heartbeat := DefaultHeartbeatConfig()
+	heartbeat.Override(HeartbeatConfig{
+		Interval:     time.Duration(h.Interval) * time.Second,
+		Timeout:      time.Duration(h.Timeout) * time.Second,
+		TCPKeepAlive: time.Duration(h.TCPKeepAlive) * time.Second,
+	})
+	return heartbeat
+}
+
+type RateLimitYaml struct {
+	Rate    string                `yaml:"rate"`
+	Burst   string                `yaml:"burst"`
+	Clients []ClientRateLimitYaml `yaml:"clients"`
+}
+
+// 单独配置的客户端限速，按密钥或者证书身份匹配
+type ClientRateLimitYaml struct {
+	Key      string `yaml:"key"`
+	Identity string `yaml:"identity"`
+	Rate     string `yaml:"rate"`
+	Burst    string `yaml:"burst"`
+}
+
+// 转换限速配置，单独配置的限速按密钥或者证书身份保存
+func (r RateLimitYaml) toRateLimits() (RateLimit, map[string]RateLimit, error) {
+	limit, err := ParseRateLimit(r.Rate, r.Burst)
+	if err != nil {
+		return RateLimit{}, nil, err
+	}
+
+	limits := make(map[string]RateLimit)
+	for _, client := range r.Clients {
+		clientLimit, err := ParseRateLimit(client.Rate, client.Burst)
+		if err != nil {
+			return RateLimit{}, nil, err
+		}
+		if client.Identity != "" {
+			limits[ClientLimitIdentity(client.Identity, "")] = clientLimit
+		}
+		if client.Key != "" {
+			limits[ClientLimitIdentity("", client.Key)] = clientLimit
+		}
+	}
+	return limit, limits, nil
+}
+
+type ConnLimitYaml struct {
+	MaxConns     uint32                `yaml:"max-conns"`
+	Rate         uint32                `yaml:"rate"`
+	Burst        uint32                `yaml:"burst"`
+	QueueTimeout uint32                `yaml:"queue-timeout"`
+	Clients      []ClientConnLimitYaml `yaml:"clients"`
+}
+
+// 单独配置的客户端连接数限制，按密钥或者证书身份匹配
+type ClientConnLimitYaml struct {
+	Key          string `yaml:"key"`
+	Identity     string `yaml:"identity"`
+	MaxConns     uint32 `yaml:"max-conns"`
+	Rate         uint32 `yaml:"rate"`
+	Burst        uint32 `yaml:"burst"`
+	QueueTimeout uint32 `yaml:"queue-timeout"`
+}
+
+func toConnLimit(maxConns, rate, burst, queueTimeout uint32) ConnLimit {
+	return ConnLimit{
+		MaxConns:     int64(maxConns),
+		Rate:         int64(rate),
+		Burst:        int64(burst),
+		QueueTimeout: time.Duration(queueTimeout) * time.Second,
+	}
+}
+
+// 转换连接数限制，单独配置的限制按密钥或者证书身份保存
+func (c ConnLimitYaml) toConnLimits() (ConnLimit, map[string]ConnLimit) {
+	limits := make(map[string]ConnLimit)
+	for _, client := range c.Clients {
+		clientLimit := toConnLimit(client.MaxConns, client.Rate, client.Burst, client.QueueTimeout)
+		if client.Identity != "" {
+			limits[ClientLimitIdentity(client.Identity, "")] = clientLimit
+		}
+		if client.Key != "" {
+			limits[ClientLimitIdentity("", client.Key)] = clientLimit
+		}
+	}
+	return toConnLimit(c.MaxConns, c.Rate, c.Burst, c.QueueTimeout), limits
+}
+
+type IPFilterYaml struct {
+	Allow []string           `yaml:"allow"`
+	Deny  []string           `yaml:"deny"`
+	Ports []PortIPFilterYaml `yaml:"ports"`
+}
+
+// 单独配置的代理端口访问地址过滤
+type PortIPFilterYaml struct {
+	Port  uint32   `yaml:"port"`
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// 转换访问地址过滤，单独配置的过滤按代理端口保存
+func (f IPFilterYaml) toIPFilters() (IPFilter, map[uint32]IPFilter, error) {
+	filter, err := ParseIPFilter(f.Allow, f.Deny)
+	if err != nil {
+		return IPFilter{}, nil, err
+	}
+
+	filters := make(map[uint32]IPFilter)
+	for _, port := range f.Ports {
+		if !checkPort(port.Port) {
+			return IPFilter{}, nil, fmt.Errorf("端口号配置错误：%d", port.Port)
+		}
+		portFilter, err := ParseIPFilter(port.Allow, port.Deny)
+		if err != nil {
+			return IPFilter{}, nil, err
+		}
+		filters[port.Port] = portFilter
+	}
+	return filter, filters, nil
+}
+
+type AdminYaml struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+}
+
 type Yaml struct {
 	Server struct {
-		Key          string `yaml:"key"`
-		Port         uint32 `yaml:"port"`
-		MinProxyPort uint32 `yaml:"min-proxy-port"`
-		MaxProxyPort uint32 `yaml:"max-proxy-port"`
+		Key               string                 `yaml:"key"`
+		Port              uint32                 `yaml:"port"`
+		BindAddr          string                 `yaml:"bind-addr"`
+		ProxyBindAddr     string                 `yaml:"proxy-bind-addr"`
+		MinProxyPort      uint32                 `yaml:"min-proxy-port"`
+		MaxProxyPort      uint32                 `yaml:"max-proxy-port"`
+		TLS               TLSYaml                `yaml:"tls"`
+		HTTPPort          uint32                 `yaml:"http-port"`
+		HTTPSPort         uint32                 `yaml:"https-port"`
+		Heartbeat         HeartbeatYaml          `yaml:"heartbeat"`
+		DrainTimeout      uint32                 `yaml:"drain-timeout"`
+		Admin             AdminYaml              `yaml:"admin"`
+		RevocationFile    string                 `yaml:"revocation-file"`
+		ChallengeAuthOnly bool                   `yaml:"challenge-auth-only"`
+		Clients           []ClientCredentialYaml `yaml:"clients"`
+		RateLimit         RateLimitYaml          `yaml:"rate-limit"`
+		ConnLimit         ConnLimitYaml          `yaml:"conn-limit"`
+		IPFilter          IPFilterYaml           `yaml:"ip-filter"`
+		MetricsAddr       string                 `yaml:"metrics-addr"`
+		MetricsToken      string                 `yaml:"metrics-token"`
 	}
 	Client struct {
-		Key           string   `yaml:"key"`
-		ServerAddr    string   `yaml:"server-addr"`
-		ProxyMappings []string `yaml:"proxy-mappings"`
-		TunnelCount   int      `yaml:"tunnel-count"`
+		Key           string        `yaml:"key"`
+		ClientID      string        `yaml:"client-id"`
+		ServerAddr    string        `yaml:"server-addr"`
+		ProxyMappings []string      `yaml:"proxy-mappings"`
+		TLS           TLSYaml       `yaml:"tls"`
+		Heartbeat     HeartbeatYaml `yaml:"heartbeat"`
+		MetricsAddr   string        `yaml:"metrics-addr"`
+		MetricsToken  string        `yaml:"metrics-token"`
 	}
 }
 
 var Config = new(Yaml)
 
-func LoadConfigFile() {
+// 配置文件路径，与可执行文件在同一目录
+func ConfigFilePath() (string, error) {
 	// 获取可执行文件相对于当前工作目录的相对路径
 	root := filepath.Dir(os.Args[0])
 
 	// 根据相对路径获取可执行文件的绝对路径
 	root, err := filepath.Abs(root)
 	if err != nil {
-		log.Fatalf("加载配置文件失败，%v\n", err)
+		return "", err
 	}
 
-	configFilePath := root + string(filepath.Separator) + "config.yml"
+	return root + string(filepath.Separator) + "config.yml", nil
+}
 
-	configFile, err := ioutil.ReadFile(configFilePath)
+// 读取并解析配置文件
+func readConfigFile() (*Yaml, error) {
+	configFilePath, err := ConfigFilePath()
+	if err != nil {
+		return nil, fmt.Errorf("加载配置文件失败，%w", err)
+	}
 
+	configFile, err := ioutil.ReadFile(configFilePath)
 	if err != nil {
-		log.Fatalf("加载配置文件失败，%v\n", err)
+		return nil, fmt.Errorf("加载配置文件失败，%w", err)
 	}
 
-	err = yaml.Unmarshal(configFile, Config)
+	yamlConfig := new(Yaml)
+	if err = yaml.Unmarshal(configFile, yamlConfig); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+	return yamlConfig, nil
+}
 
+func LoadConfigFile() {
+	yamlConfig, err := readConfigFile()
 	if err != nil {
-		log.Fatalf("解析配置文件失败: %v\n", err)
+		log.Fatalln(err)
 	}
+	Config = yamlConfig
 }
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 访问连接数限制
+type ConnLimit struct {
+	MaxConns     int64         // 最大并发连接数，为0时不限制
+	Rate         int64         // 每秒新建连接数，为0时不限制
+	Burst        int64         // 新建连接允许的突发数，为0时与 Rate 相同
+	QueueTimeout time.Duration // 超出限制时排队等待的时间，为0时直接拒绝
+}
+
+// 是否限制
+func (c ConnLimit) Enabled() bool {
+	return c.MaxConns > 0 || c.Rate > 0
+}
+
+// 转字符串
+func (c ConnLimit) String() string {
+	if !c.Enabled() {
+		return "不限连接数"
+	}
+	var items []string
+	if c.MaxConns > 0 {
+		items = append(items, fmt.Sprintf("最大连接数 %d", c.MaxConns))
+	}
+	if c.Rate > 0 {
+		items = append(items, fmt.Sprintf("每秒新建连接 %d", c.Rate))
+	}
+	if c.QueueTimeout > 0 {
+		items = append(items, fmt.Sprintf("排队 %s", c.QueueTimeout))
+	}
+	return strings.Join(items, "，")
+}
+
+// 新建连接的限速，用于令牌桶
+func (c ConnLimit) RateLimit() RateLimit {
+	return RateLimit{Rate: c.Rate, Burst: c.Burst}
+}
+
+// 解析连接数限制，参数为空时不限制，排队时间单位为秒
+func ParseConnLimit(maxConns string, rate string, burst string, queueTimeout string) (ConnLimit, error) {
+	var limit ConnLimit
+	var err error
+	if limit.MaxConns, err = parseCount(maxConns); err != nil {
+		return ConnLimit{}, fmt.Errorf("最大连接数格式不对：%s", maxConns)
+	}
+	if limit.Rate, err = parseCount(rate); err != nil {
+		return ConnLimit{}, fmt.Errorf("每秒新建连接数格式不对：%s", rate)
+	}
+	if limit.Burst, err = parseCount(burst); err != nil {
+		return ConnLimit{}, fmt.Errorf("新建连接突发数格式不对：%s", burst)
+	}
+	seconds, err := parseCount(queueTimeout)
+	if err != nil {
+		return ConnLimit{}, fmt.Errorf("排队时间格式不对：%s", queueTimeout)
+	}
+	limit.QueueTimeout = time.Duration(seconds) * time.Second
+	return limit, nil
+}
+
+// 解析非负整数，为空时返回0
+func parseCount(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return 0, nil
+	}
+	count, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("格式不对：%s", str)
+	}
+	return count, nil
+}
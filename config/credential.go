@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 客户端凭据公开部分的前缀，之后为客户端编号，挑战应答认证时发送给服务端
+const credentialTokenPrefix = "client:"
+
+// 客户端凭据，服务端为每个客户端单独配置的密钥及允许使用的访问端口、域名
+// 配置了的访问端口及域名归该客户端所有，其他客户端不能使用
+type ClientCredential struct {
+	ID         string      // 客户端编号
+	Secret     string      // 客户端密钥，只用于挑战应答认证，不在网络中传输
+	PortRanges []PortRange // 允许的访问端口范围，为空时不限制
+	Domains    []string    // 允许的访问域名，支持泛域名 *.aulang.cn，为空时不限制
+	ProxyTypes []string    // 允许的代理类型，为空时不限制
+}
+
+// 凭据对应的密钥声明
+func (c ClientCredential) Claims() KeyClaims {
+	return KeyClaims{
+		ClientID:   c.ID,
+		PortRanges: c.PortRanges,
+		Domains:    c.Domains,
+		ProxyTypes: c.ProxyTypes,
+	}
+}
+
+// 与另一个凭据是否相同
+func (c ClientCredential) Equal(other ClientCredential) bool {
+	return c.ID == other.ID && c.Secret == other.Secret &&
+		FormatPortRanges(c.PortRanges) == FormatPortRanges(other.PortRanges) &&
+		strings.Join(c.Domains, ",") == strings.Join(other.Domains, ",") &&
+		strings.Join(c.ProxyTypes, ",") == strings.Join(other.ProxyTypes, ",")
+}
+
+// 客户端凭据的公开部分
+func CredentialToken(id string) string {
+	return credentialTokenPrefix + id
+}
+
+// 由公开部分取得客户端编号，不是客户端凭据时返回 false
+func CredentialID(token string) (string, bool) {
+	if !strings.HasPrefix(token, credentialTokenPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(token, credentialTokenPrefix), true
+}
+
+// 域名是否匹配，泛域名 *.aulang.cn 匹配所有子域名，包括同样为泛域名的子域名
+func matchDomain(pattern string, domain string) bool {
+	if pattern == domain {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(domain, pattern[1:])
+}
+
+type ClientCredentialYaml struct {
+	ID      string   `yaml:"id"`
+	Secret  string   `yaml:"secret"`
+	Ports   string   `yaml:"ports"`
+	Domains []string `yaml:"domains"`
+	Types   string   `yaml:"types"`
+}
+
+// 转换客户端凭据，按客户端编号保存
+func toClientCredentials(clients []ClientCredentialYaml) (map[string]ClientCredential, error) {
+	credentials := make(map[string]ClientCredential)
+	for _, client := range clients {
+		id := strings.TrimSpace(client.ID)
+		if id == "" {
+			return nil, errors.New("客户端编号不能为空")
+		}
+		if _, exists := credentials[id]; exists {
+			return nil, fmt.Errorf("客户端编号重复：%s", id)
+		}
+		if client.Secret == "" {
+			return nil, fmt.Errorf("客户端密钥不能为空：%s", id)
+		}
+		ranges, err := ParsePortRanges(client.Ports)
+		if err != nil {
+			return nil, err
+		}
+		types, err := ParseProxyTypes(client.Types)
+		if err != nil {
+			return nil, err
+		}
+		var domains []string
+		for _, domain := range client.Domains {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		credentials[id] = ClientCredential{
+			ID:         id,
+			Secret:     client.Secret,
+			PortRanges: ranges,
+			Domains:    domains,
+			ProxyTypes: types,
+		}
+	}
+	return credentials, nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// 默认心跳间隔
+	defaultHeartbeatInterval = 10 * time.Second
+	// 默认心跳超时时间
+	defaultHeartbeatTimeout = 30 * time.Second
+	// 默认TCP keepalive 间隔
+	defaultTCPKeepAlive = 15 * time.Second
+)
+
+// 心跳配置
+type HeartbeatConfig struct {
+	Interval     time.Duration // 心跳间隔，客户端按此间隔发送心跳
+	Timeout      time.Duration // 心跳超时时间，超过该时间未收到对端消息则断开连接
+	TCPKeepAlive time.Duration // 桥接连接的TCP keepalive 间隔
+}
+
+// 默认心跳配置
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		Interval:     defaultHeartbeatInterval,
+		Timeout:      defaultHeartbeatTimeout,
+		TCPKeepAlive: defaultTCPKeepAlive,
+	}
+}
+
+// 未配置的项使用默认值
+func (c *HeartbeatConfig) SetDefaults() {
+	defaults := DefaultHeartbeatConfig()
+	defaults.Override(*c)
+	*c = defaults
+}
+
+// 检查配置，超时时间必须大于心跳间隔
+func (c *HeartbeatConfig) Check() error {
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return errors.New("心跳间隔及超时时间必须大于0")
+	}
+	if c.Timeout <= c.Interval {
+		return errors.New("心跳超时时间必须大于心跳间隔")
+	}
+	return nil
+}
+
+// 使用命令行参数覆盖心跳配置
+func (c *HeartbeatConfig) Override(args HeartbeatConfig) {
+	if args.Interval > 0 {
+		c.Interval = args.Interval
+	}
+	if args.Timeout > 0 {
+		c.Timeout = args.Timeout
+	}
+	if args.TCPKeepAlive > 0 {
+		c.TCPKeepAlive = args.TCPKeepAlive
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 访问地址过滤，拒绝列表优先于允许列表
+type IPFilter struct {
+	Allow []string // 允许的地址段，为空时允许所有地址
+	Deny  []string // 拒绝的地址段
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// 解析访问地址过滤，地址段格式如 192.168.1.0/24，单个IP视为只包含该地址的地址段
+func ParseIPFilter(allow []string, deny []string) (IPFilter, error) {
+	var filter IPFilter
+	var err error
+	if filter.Allow, filter.allow, err = parseCIDRs(allow); err != nil {
+		return IPFilter{}, err
+	}
+	if filter.Deny, filter.deny, err = parseCIDRs(deny); err != nil {
+		return IPFilter{}, err
+	}
+	return filter, nil
+}
+
+// 解析多个地址段，返回规范化之后的字符串
+func parseCIDRs(items []string) ([]string, []*net.IPNet, error) {
+	var cidrs []string
+	var nets []*net.IPNet
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, nil, fmt.Errorf("IP地址格式不对：%s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("地址段格式不对：%s", item)
+		}
+		cidrs = append(cidrs, ipNet.String())
+		nets = append(nets, ipNet)
+	}
+	return cidrs, nets, nil
+}
+
+// 是否配置了过滤
+func (f IPFilter) Enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+// 是否允许访问，无法取得IP时只在未配置过滤时允许
+func (f IPFilter) Allowed(ip net.IP) bool {
+	if !f.Enabled() {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 转字符串
+func (f IPFilter) String() string {
+	if !f.Enabled() {
+		return "不限访问地址"
+	}
+	return fmt.Sprintf("允许%v，拒绝%v", f.Allow, f.Deny)
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 第二版密钥前缀，之后为 base64 编码的 随机数|AES-GCM 密文，整个密钥在握手时发送，仍可使用，不再生成
+	keyPrefixV2 = "v2."
+	// 新版密钥前缀，格式同第二版，之后为用 . 分隔的认证密文
+	// 前两部分为密钥的公开部分，挑战应答认证时只发送公开部分，认证密文由服务端通过种子推导
+	keyPrefixV3 = "v3."
+)
+
+// 密钥的附加认证数据，避免与其他用途的密文混用
+// 两版密钥不同，新版密钥的公开部分改为第二版前缀之后不能作为第二版密钥使用
+var (
+	keyAdditionalDataV2 = []byte("netbus-key-v2")
+	keyAdditionalDataV3 = []byte("netbus-key-v3")
+)
+
+// 密钥声明，限制客户端可以使用的访问端口及代理类型
+type KeyClaims struct {
+	ID         string      // 密钥编号，用于吊销，旧版密钥及超级密钥为空
+	ClientID   string      // 客户端编号，为空时未指定
+	PortRanges []PortRange // 允许的访问端口范围，为空时不限制
+	Domains    []string    // 允许的访问域名，为空时不限制，只有客户端凭据可以配置
+	ProxyTypes []string    // 允许的代理类型，为空时不限制
+	ExpiresAt  time.Time   // 过期时间，超级密钥为零
+	IssuedAt   time.Time   // 签发时间，旧版密钥及超级密钥为零
+}
+
+// 访问端口范围，包含边界
+type PortRange struct {
+	Min uint32
+	Max uint32
+}
+
+// 转字符串
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// 是否允许使用访问端口
+func (c KeyClaims) AllowPort(port uint32) bool {
+	if len(c.PortRanges) == 0 {
+		return true
+	}
+	for _, r := range c.PortRanges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否允许使用访问域名
+func (c KeyClaims) AllowDomain(domain string) bool {
+	if len(c.Domains) == 0 {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	for _, pattern := range c.Domains {
+		if matchDomain(pattern, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否允许使用代理类型
+func (c KeyClaims) AllowProxyType(proxyType string) bool {
+	if len(c.ProxyTypes) == 0 {
+		return true
+	}
+	for _, t := range c.ProxyTypes {
+		if t == proxyType {
+			return true
+		}
+	}
+	return false
+}
+
+// 转字符串
+func (c KeyClaims) String() string {
+	var items []string
+	if c.ID != "" {
+		items = append(items, "密钥编号："+c.ID)
+	}
+	if c.ClientID != "" {
+		items = append(items, "客户端："+c.ClientID)
+	}
+	if len(c.PortRanges) > 0 {
+		items = append(items, "访问端口："+FormatPortRanges(c.PortRanges))
+	}
+	if len(c.Domains) > 0 {
+		items = append(items, "访问域名："+strings.Join(c.Domains, ","))
+	}
+	if len(c.ProxyTypes) > 0 {
+		items = append(items, "代理类型："+strings.Join(c.ProxyTypes, ","))
+	}
+	if !c.ExpiresAt.IsZero() {
+		items = append(items, "过期时间："+c.ExpiresAt.Format(keyTimeLayouts[0]))
+	}
+	return strings.Join(items, "，")
+}
+
+// 解析访问端口范围，多个用逗号分隔，格式如 10000-10010,13389
+func ParsePortRanges(str string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		min, err := parsePort(bounds[0])
+		if err != nil || !checkPort(min) {
+			return nil, fmt.Errorf("访问端口范围格式不对：%s", item)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = parsePort(bounds[1]); err != nil || !checkPort(max) || max < min {
+				return nil, fmt.Errorf("访问端口范围格式不对：%s", item)
+			}
+		}
+		ranges = append(ranges, PortRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+// 格式化访问端口范围
+func FormatPortRanges(ranges []PortRange) string {
+	items := make([]string, len(ranges))
+	for i, r := range ranges {
+		items[i] = r.String()
+	}
+	return strings.Join(items, ",")
+}
+
+// 解析代理类型，多个用逗号分隔
+func ParseProxyTypes(str string) ([]string, error) {
+	var types []string
+	for _, item := range strings.Split(str, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch item {
+		case "":
+			continue
+		case ProxyTypeTCP, ProxyTypeUDP, ProxyTypeHTTP, ProxyTypeHTTPS:
+			types = append(types, item)
+		default:
+			return nil, fmt.Errorf("代理类型不支持：%s", item)
+		}
+	}
+	return types, nil
+}
+
+// 过期时间支持的格式，只有日期时为当天零点，使用本地时区
+var keyTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04", timeLayout}
+
+// 解析过期时间，为空时30天后过期
+func ParseKeyExpiry(str string) (time.Time, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return time.Now().Add(30 * 24 * time.Hour), nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	for _, layout := range keyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("过期时间格式不对：%s，格式如 2020-12-31 或者 2020-12-31T18:00", str)
+}
+
+// 密钥声明的编码格式，时间为 Unix 秒数
+type keyClaimsJSON struct {
+	ID       string   `json:"jti,omitempty"`
+	ClientID string   `json:"cid,omitempty"`
+	Ports    string   `json:"ports,omitempty"`
+	Types    []string `json:"types,omitempty"`
+	Expires  int64    `json:"exp"`
+	Issued   int64    `json:"iat"`
+}
+
+// 由种子生成 AES-256-GCM
+func keyAEAD(seed string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(seed))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 生成新版密钥，使用随机数加密并认证密钥声明
+func newKeyV3(seed string, claims KeyClaims) (string, error) {
+	body, err := json.Marshal(keyClaimsJSON{
+		ID:       claims.ID,
+		ClientID: claims.ClientID,
+		Ports:    FormatPortRanges(claims.PortRanges),
+		Types:    claims.ProxyTypes,
+		Expires:  claims.ExpiresAt.Unix(),
+		Issued:   claims.IssuedAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := keyAEAD(seed)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, body, keyAdditionalDataV3)
+	token := keyPrefixV3 + base64.RawURLEncoding.EncodeToString(sealed)
+	return token + "." + base64.RawURLEncoding.EncodeToString(keySecret(seed, token)), nil
+}
+
+// 新版密钥的认证密文，由种子及公开部分推导
+func keySecret(seed string, token string) []byte {
+	mac := hmac.New(sha256.New, []byte(seed))
+	mac.Write([]byte("netbus-key-secret|"))
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+// 拆分新版密钥的公开部分及认证密文
+func splitKeyV3(key string) (string, []byte, bool) {
+	index := strings.LastIndex(key, ".")
+	if !strings.HasPrefix(key, keyPrefixV3) || index < len(keyPrefixV3) {
+		return "", nil, false
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(key[index+1:])
+	if err != nil || len(secret) != sha256.Size {
+		return "", nil, false
+	}
+	return key[:index], secret, true
+}
+
+// 生成随机的密钥编号
+func newKeyID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// 解析第二版密钥或者新版密钥的公开部分，密钥被篡改或者不是由该种子生成时返回错误
+func parseSealedKey(seed string, token string) (KeyClaims, error) {
+	additionalData, payload := keyAdditionalDataV3, strings.TrimPrefix(token, keyPrefixV3)
+	if strings.HasPrefix(token, keyPrefixV2) {
+		additionalData, payload = keyAdditionalDataV2, strings.TrimPrefix(token, keyPrefixV2)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return KeyClaims{}, err
+	}
+	aead, err := keyAEAD(seed)
+	if err != nil {
+		return KeyClaims{}, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return KeyClaims{}, errors.New("密钥长度不对")
+	}
+	body, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return KeyClaims{}, err
+	}
+
+	var encoded keyClaimsJSON
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		return KeyClaims{}, err
+	}
+	ranges, err := ParsePortRanges(encoded.Ports)
+	if err != nil {
+		return KeyClaims{}, err
+	}
+	return KeyClaims{
+		ID:         encoded.ID,
+		ClientID:   encoded.ClientID,
+		PortRanges: ranges,
+		ProxyTypes: encoded.Types,
+		ExpiresAt:  time.Unix(encoded.Expires, 0),
+		IssuedAt:   time.Unix(encoded.Issued, 0),
+	}, nil
+}
@@ -1,10 +1,12 @@
 package config
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
@@ -13,37 +15,19 @@ import (
 // 固定格式
 const timeLayout = "2006-01-02"
 
-func padding(cipherText []byte, blockSize int) []byte {
-	padding := blockSize - len(cipherText)%blockSize
-	padText := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(cipherText, padText...)
-}
-
-func unPadding(origData []byte) []byte {
+func unPadding(origData []byte, blockSize int) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, errors.New("密文长度不对")
+	}
 	unPadding := int(origData[length-1])
-	return origData[:(length - unPadding)]
-}
-
-//AES加密
-func encrypt(original, key string) (string, error) {
-	originalBytes := []byte(original)
-	keyBytes := []byte(key)
-
-	block, err := aes.NewCipher(keyBytes)
-	if err != nil {
-		return "", err
+	if unPadding == 0 || unPadding > blockSize || unPadding > length {
+		return nil, errors.New("填充格式不对")
 	}
-	blockSize := block.BlockSize()
-	originalBytes = padding(originalBytes, blockSize)
-	blockMode := cipher.NewCBCEncrypter(block, keyBytes[:blockSize])
-	encrypted := make([]byte, len(originalBytes))
-	blockMode.CryptBlocks(encrypted, originalBytes)
-
-	return base64.StdEncoding.EncodeToString(encrypted), nil
+	return origData[:(length - unPadding)], nil
 }
 
-//AES解密
+// AES解密，仅用于旧版密钥
 func decrypt(encrypted, key string) (string, error) {
 	encryptedBytes, err := base64.StdEncoding.DecodeString(encrypted)
 	if err != nil {
@@ -56,10 +40,15 @@ func decrypt(encrypted, key string) (string, error) {
 		return "", err
 	}
 	blockSize := block.BlockSize()
+	if len(encryptedBytes) == 0 || len(encryptedBytes)%blockSize != 0 {
+		return "", errors.New("密文长度不对")
+	}
 	blockMode := cipher.NewCBCDecrypter(block, keyBytes[:blockSize])
 	origData := make([]byte, len(encryptedBytes))
 	blockMode.CryptBlocks(origData, encryptedBytes)
-	origData = unPadding(origData)
+	if origData, err = unPadding(origData, blockSize); err != nil {
+		return "", err
+	}
 
 	return string(origData), nil
 }
@@ -71,36 +60,137 @@ func fixLength(seed string) string {
 	return seed + strings.Repeat("=", 16-len(seed)%16)
 }
 
-// 生成 key
-func NewKey(seed, expired string) (string, error) {
-	ex, err := time.Parse(timeLayout, expired)
-	if err != nil {
-		ex = time.Now().Add(30 * 24 * time.Hour)
+// 生成 key，未指定签发时间时使用当前时间，未指定编号时随机生成
+func NewKey(seed string, claims KeyClaims) (string, error) {
+	if claims.ExpiresAt.IsZero() {
+		return "", errors.New("缺少过期时间")
+	}
+	if claims.IssuedAt.IsZero() {
+		claims.IssuedAt = time.Now()
+	}
+	if claims.ID == "" {
+		var err error
+		if claims.ID, err = newKeyID(); err != nil {
+			return "", err
+		}
 	}
-	expired = ex.Format(timeLayout)
+	return newKeyV3(seed, claims)
+}
 
-	// 种子必须是 16的位数
-	seed = fixLength(seed)
-	return encrypt(expired, seed)
+// 检查 key 是否有效，返回密钥声明，已过期的密钥同样返回声明
+// 兼容第二版密钥及旧版密钥，旧版密钥只有过期日期
+func CheckKey(seed, key string) (KeyClaims, bool) {
+	claims, err := ParseKey(seed, key)
+	return claims, checked(claims, err)
+}
+
+// 解析 key 的声明，不检查是否过期，也不记录日志，用于查看已通过校验的客户端
+func ParseKey(seed, key string) (KeyClaims, error) {
+	if KeyFormatDeprecated(key) {
+		return KeyClaims{}, errors.New("密钥格式已废弃，请使用 -generate 重新创建密钥")
+	}
+	if strings.HasPrefix(key, keyPrefixV3) {
+		token, secret, ok := splitKeyV3(key)
+		if !ok || !hmac.Equal(secret, keySecret(seed, token)) {
+			return KeyClaims{}, errors.New("校验密钥失败")
+		}
+		key = token
+	}
+	return parseKeyToken(seed, key)
 }
 
-// 检查 key 是否有效
-func CheckKey(seed, key string) (time.Time, bool) {
+// 是否为已废弃的密钥格式，即带认证密文的第二版密钥，其公开部分曾在挑战应答认证中发送，不再接受
+func KeyFormatDeprecated(key string) bool {
+	return strings.HasPrefix(key, keyPrefixV2) && strings.Contains(strings.TrimPrefix(key, keyPrefixV2), ".")
+}
+
+// 检查密钥的公开部分是否有效，返回密钥声明，不校验客户端是否持有完整的密钥
+// 只用于已通过挑战应答认证或者已校验过完整密钥的客户端，超级密钥、第二版密钥及旧版密钥的公开部分为密钥本身
+func CheckKeyToken(seed, token string) (KeyClaims, bool) {
+	claims, err := parseKeyToken(seed, token)
+	return claims, checked(claims, err)
+}
+
+// 解析失败时记录原因，解析成功时检查是否过期，超级密钥不会过期
+func checked(claims KeyClaims, err error) bool {
+	if err != nil {
+		if err != errKeyEmpty {
+			log.Println(err.Error())
+		}
+		return false
+	}
+	return claims.ExpiresAt.IsZero() || time.Now().Before(claims.ExpiresAt)
+}
+
+// 密钥为空，不记录日志
+var errKeyEmpty = errors.New("密钥为空")
+
+// 解析密钥公开部分的声明，不检查是否过期
+func parseKeyToken(seed, token string) (KeyClaims, error) {
+	if token == "" {
+		return KeyClaims{}, errKeyEmpty
+	}
 	// 超级 key
-	if key == seed {
-		return time.Time{}, true
+	if token == seed {
+		return KeyClaims{}, nil
+	}
+
+	if strings.HasPrefix(token, keyPrefixV2) || strings.HasPrefix(token, keyPrefixV3) {
+		claims, err := parseSealedKey(seed, token)
+		if err != nil {
+			return KeyClaims{}, fmt.Errorf("解析密钥失败：%v", err)
+		}
+		return claims, nil
 	}
 
+	// 旧版密钥
 	seed = fixLength(seed)
-	expired, err := decrypt(key, seed)
+	expired, err := decrypt(token, seed)
 	if err != nil {
-		log.Println("解密密钥失败！", err)
-		return time.Time{}, false
+		return KeyClaims{}, fmt.Errorf("解密密钥失败：%v", err)
 	}
 
 	ex, err := time.Parse(timeLayout, expired)
 	if err != nil {
-		log.Println("解析密钥失败！", err)
+		return KeyClaims{}, fmt.Errorf("解析密钥失败：%v", err)
 	}
-	return ex, time.Now().Before(ex)
+	return KeyClaims{ExpiresAt: ex}, nil
+}
+
+// 密钥的公开部分，新版密钥去掉认证密文，其他密钥原样返回
+func KeyToken(key string) string {
+	if token, _, ok := splitKeyV3(key); ok {
+		return token
+	}
+	return key
+}
+
+// 挑战应答认证使用的密钥，返回发送给服务端的公开部分及计算证明的密文
+// 超级密钥的公开部分为空，由服务端使用种子校验，第二版密钥及旧版密钥无法由服务端推导密文，返回 false
+func SplitKey(key string) (string, []byte, bool) {
+	if strings.HasPrefix(key, keyPrefixV3) {
+		return splitKeyV3(key)
+	}
+	if strings.HasPrefix(key, keyPrefixV2) || legacyKeyFormat(key) {
+		return "", nil, false
+	}
+	return "", []byte(key), true
+}
+
+// 服务端由密钥的公开部分推导计算证明的密文，公开部分为空时为超级密钥，无法推导时返回空
+func KeySecret(seed, token string) []byte {
+	switch {
+	case token == "":
+		return []byte(seed)
+	case strings.HasPrefix(token, keyPrefixV3):
+		return keySecret(seed, token)
+	default:
+		return nil
+	}
+}
+
+// 是否为旧版密钥的格式，旧版密钥为 AES 密文的 base64 编码
+func legacyKeyFormat(key string) bool {
+	data, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(data) > 0 && len(data)%aes.BlockSize == 0
 }
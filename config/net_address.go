@@ -3,8 +3,25 @@ package config
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// 代理类型
+const (
+	ProxyTypeTCP   = "tcp"
+	ProxyTypeUDP   = "udp"
+	ProxyTypeHTTP  = "http"
+	ProxyTypeHTTPS = "https"
+)
+
+// PROXY protocol 版本，客户端连接本地服务时发送访问者地址
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
 )
 
 // 网络地址
@@ -12,16 +29,92 @@ type NetAddress struct {
 	Host      string
 	Port      uint32
 	ProxyPort uint32
+	Type      string    // 代理类型，默认 tcp
+	Domains   []string  // 访问域名，仅 http、https 代理使用
+	RateLimit RateLimit // 代理限速，由服务端在两个方向上分别限制
+	ConnLimit ConnLimit // 访问连接数限制，由服务端限制
+	IPFilter  IPFilter  // 访问地址过滤，由服务端过滤
+	// 连接本地服务时发送的 PROXY protocol 版本，为空时不发送，不支持 udp 代理
+	ProxyProtocol string
+	// 服务端监听访问端口的地址，为空时使用服务端配置，不支持域名代理
+	BindAddr string
+	// 负载均衡组，多个客户端共享同一个访问端口，只支持指定访问端口的 tcp 代理
+	Group ProxyGroup
 }
 
 // 转字符串
 func (n *NetAddress) String() string {
-	return fmt.Sprintf("%s:%d", n.Host, n.Port)
+	return net.JoinHostPort(n.Host, strconv.Itoa(int(n.Port)))
 }
 
 // 完整字符串
 func (n *NetAddress) FullString() string {
-	return fmt.Sprintf("%s:%d:%d", n.Host, n.Port, n.ProxyPort)
+	query := url.Values{}
+	if n.RateLimit.Enabled() {
+		query.Set("rate", FormatByteSize(n.RateLimit.Rate))
+		if n.RateLimit.Burst > 0 {
+			query.Set("burst", FormatByteSize(n.RateLimit.Burst))
+		}
+	}
+	for name, value := range map[string]int64{
+		"max-conns":     n.ConnLimit.MaxConns,
+		"conn-rate":     n.ConnLimit.Rate,
+		"conn-burst":    n.ConnLimit.Burst,
+		"queue-timeout": int64(n.ConnLimit.QueueTimeout / time.Second),
+	} {
+		if value > 0 {
+			query.Set(name, strconv.FormatInt(value, 10))
+		}
+	}
+	if n.BindAddr != "" {
+		query.Set("bind", n.BindAddr)
+	}
+	if n.ProxyProtocol != "" {
+		query.Set("proxy-protocol", n.ProxyProtocol)
+	}
+	if n.Group.Enabled() {
+		query.Set("group", n.Group.Name)
+		query.Set("balance", n.Group.Balance)
+		if n.Group.Weight > 1 {
+			query.Set("weight", strconv.FormatInt(n.Group.Weight, 10))
+		}
+	}
+	if len(n.IPFilter.Allow) > 0 {
+		query["allow"] = n.IPFilter.Allow
+	}
+	if len(n.IPFilter.Deny) > 0 {
+		query["deny"] = n.IPFilter.Deny
+	}
+	if n.IsDomainProxy() {
+		query["domain"] = n.Domains
+		return fmt.Sprintf("%s://%s?%s", n.Type, n.String(), query.Encode())
+	}
+
+	var params string
+	if len(query) > 0 {
+		params = "?" + query.Encode()
+	}
+	proxyPort := "auto"
+	if n.ProxyPort != 0 {
+		proxyPort = strconv.Itoa(int(n.ProxyPort))
+	}
+	if n.Type != "" && n.Type != ProxyTypeTCP {
+		return fmt.Sprintf("%s://%s:%s%s", n.Type, n.String(), proxyPort, params)
+	}
+	return fmt.Sprintf("%s:%s%s", n.String(), proxyPort, params)
+}
+
+// 是否按域名代理，域名代理共享服务端端口，不需要访问端口
+func (n *NetAddress) IsDomainProxy() bool {
+	return n.Type == ProxyTypeHTTP || n.Type == ProxyTypeHTTPS
+}
+
+// 网络类型，用于拨号及监听
+func (n *NetAddress) Network() string {
+	if n.Type == ProxyTypeUDP {
+		return "udp"
+	}
+	return "tcp"
 }
 
 // 解析多个地址
@@ -40,14 +133,46 @@ func ParseNetAddresses(addresses string) ([]NetAddress, bool) {
 
 // 解析单个网络地址
 // 支持两个端口的解析，格式如192.168.1.100:3389:13389
+// 访问端口为 auto 时由服务端分配，格式如192.168.1.100:3389:auto
+// 支持代理类型前缀，格式如udp://192.168.1.100:53:10053，默认为tcp
+// http、https 代理使用域名代替访问端口，格式如http://192.168.1.100:8080?domain=a.aulang.cn&domain=b.aulang.cn
+// 支持限速参数，单位为字节每秒，格式如192.168.1.100:8080:18080?rate=1MB&burst=4MB
+// 支持连接数限制参数，排队时间单位为秒，格式如192.168.1.100:3306:13306?max-conns=20&conn-rate=5&queue-timeout=3
+// 支持访问地址过滤参数，可重复，格式如192.168.1.100:3389:13389?allow=10.0.0.0/8&deny=10.0.0.1
+// 支持向本地服务发送 PROXY protocol 头，版本为 v1 或者 v2，格式如192.168.1.100:80:18080?proxy-protocol=v2
+// 支持指定服务端监听访问端口的地址，格式如192.168.1.100:3389:13389?bind=10.0.0.1
+// 支持加入负载均衡组，与其他客户端共享访问端口，格式如192.168.1.100:80:18080?group=web&balance=weighted&weight=3
+// IPv6 地址使用方括号，格式如[::1]:3306:13306
 func ParseNetAddress(address string) (NetAddress, bool) {
-	arr := strings.Split(strings.TrimSpace(address), ":")
-	if len(arr) < 2 {
-		log.Println("解析地址失败！")
+	address = strings.TrimSpace(address)
+	// 解析代理类型
+	proxyType := ProxyTypeTCP
+	if i := strings.Index(address, "://"); i >= 0 {
+		proxyType = strings.ToLower(address[:i])
+		address = address[i+3:]
+		switch proxyType {
+		case ProxyTypeTCP, ProxyTypeUDP, ProxyTypeHTTP, ProxyTypeHTTPS:
+		default:
+			log.Println("代理类型不支持！", proxyType)
+			return NetAddress{}, false
+		}
+	}
+	// 解析参数
+	var query url.Values
+	if i := strings.Index(address, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(address[i+1:]); err != nil {
+			log.Println("地址参数格式不对！", err)
+			return NetAddress{}, false
+		}
+		address = address[:i]
+	}
+	host, arr, ok := splitHost(strings.TrimSpace(address))
+	if !ok || len(arr) < 2 || len(arr) > 3 {
+		log.Println("解析地址失败！IPv6 地址需要使用方括号，如 [::1]:3306:13306", address)
 		return NetAddress{}, false
 	}
 	// 解析IP
-	host := strings.TrimSpace(arr[0])
 	if host == "" {
 		log.Println("地址格式不对！")
 		return NetAddress{}, false
@@ -59,15 +184,127 @@ func ParseNetAddress(address string) (NetAddress, bool) {
 		return NetAddress{}, false
 	}
 	proxyPort := port
-	// 如果配置有 port2 ，则增加解析
+	// 如果配置有 port2 ，则增加解析，auto 或者 0 表示由服务端分配
 	if len(arr) == 3 {
-		proxyPort, err = parsePort(arr[2])
-		if err != nil || !checkPort(proxyPort) {
+		if port2 := strings.ToLower(strings.TrimSpace(arr[2])); port2 == "auto" || port2 == "0" {
+			proxyPort = 0
+		} else if proxyPort, err = parsePort(arr[2]); err != nil || !checkPort(proxyPort) {
 			log.Println("地址:端口号格式不对")
 			return NetAddress{}, false
 		}
 	}
-	return NetAddress{host, port, proxyPort}, true
+	netAddress := NetAddress{Host: host, Port: port, ProxyPort: proxyPort, Type: proxyType}
+	// 限速
+	if netAddress.RateLimit, err = ParseRateLimit(query.Get("rate"), query.Get("burst")); err != nil {
+		log.Println(err)
+		return NetAddress{}, false
+	}
+	// 连接数限制
+	if netAddress.ConnLimit, err = ParseConnLimit(query.Get("max-conns"), query.Get("conn-rate"),
+		query.Get("conn-burst"), query.Get("queue-timeout")); err != nil {
+		log.Println(err)
+		return NetAddress{}, false
+	}
+	// 访问地址过滤
+	if netAddress.IPFilter, err = ParseIPFilter(query["allow"], query["deny"]); err != nil {
+		log.Println(err)
+		return NetAddress{}, false
+	}
+	// 监听地址
+	if netAddress.BindAddr, err = ParseBindAddr(query.Get("bind")); err != nil {
+		log.Println(err)
+		return NetAddress{}, false
+	}
+	if netAddress.BindAddr != "" && netAddress.IsDomainProxy() {
+		log.Println("域名代理使用服务端共享端口，不支持指定监听地址！")
+		return NetAddress{}, false
+	}
+	// PROXY protocol
+	if netAddress.ProxyProtocol, ok = parseProxyProtocol(query.Get("proxy-protocol")); !ok {
+		log.Println("PROXY protocol 版本不支持！", query.Get("proxy-protocol"))
+		return NetAddress{}, false
+	}
+	if netAddress.ProxyProtocol != "" && proxyType == ProxyTypeUDP {
+		log.Println("UDP代理不支持 PROXY protocol！")
+		return NetAddress{}, false
+	}
+	// 负载均衡组
+	if netAddress.Group, err = ParseProxyGroup(query.Get("group"), query.Get("balance"), query.Get("weight")); err != nil {
+		log.Println(err)
+		return NetAddress{}, false
+	}
+	if netAddress.Group.Enabled() && (proxyType != ProxyTypeTCP || proxyPort == 0) {
+		log.Println("负载均衡组只支持指定访问端口的 tcp 代理！")
+		return NetAddress{}, false
+	}
+	// 域名代理
+	if netAddress.IsDomainProxy() {
+		netAddress.ProxyPort = 0
+		for _, domain := range query["domain"] {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				netAddress.Domains = append(netAddress.Domains, domain)
+			}
+		}
+		if len(netAddress.Domains) == 0 {
+			log.Println("域名代理缺少访问域名！")
+			return NetAddress{}, false
+		}
+	}
+	return netAddress, true
+}
+
+// 拆分主机及端口部分，主机为方括号括起的 IPv6 地址时去掉方括号
+// 返回的端口部分第一项为主机，与不含方括号时的拆分结果一致
+func splitHost(address string) (string, []string, bool) {
+	if !strings.HasPrefix(address, "[") {
+		arr := strings.Split(address, ":")
+		return strings.TrimSpace(arr[0]), arr, true
+	}
+	i := strings.Index(address, "]")
+	if i < 0 || !strings.HasPrefix(address[i+1:], ":") {
+		return "", nil, false
+	}
+	host := address[1:i]
+	if net.ParseIP(host) == nil {
+		return "", nil, false
+	}
+	return host, append([]string{host}, strings.Split(address[i+2:], ":")...), true
+}
+
+// 解析监听地址，为空时监听所有地址，IPv6 地址可以使用方括号
+// 方括号中为空时格式不对，避免写错的地址变为监听所有地址
+func ParseBindAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", nil
+	}
+	host := addr
+	if strings.HasPrefix(addr, "[") || strings.HasSuffix(addr, "]") {
+		// 方括号须成对出现
+		if !strings.HasPrefix(addr, "[") || !strings.HasSuffix(addr, "]") {
+			return "", fmt.Errorf("监听地址格式不对：%s", addr)
+		}
+		host = addr[1 : len(addr)-1]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("监听地址格式不对：%s", addr)
+	}
+	return ip.String(), nil
+}
+
+// 解析 PROXY protocol 版本，为空时不发送
+func parseProxyProtocol(version string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(version)) {
+	case "":
+		return "", true
+	case "v1", "1":
+		return ProxyProtocolV1, true
+	case "v2", "2":
+		return ProxyProtocolV2, true
+	default:
+		return "", false
+	}
 }
 
 // 解析单个端口
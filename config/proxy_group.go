@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin = "round-robin" // 轮询，默认
+	BalanceLeastConn  = "least-conn"  // 最少连接
+	BalanceWeighted   = "weighted"    // 按权重轮询
+)
+
+const (
+	maxGroupNameLength = 64  // 负载均衡组名最大长度
+	maxGroupWeight     = 100 // 负载均衡权重最大值
+)
+
+// 负载均衡组，多个客户端使用相同的组名注册同一个访问端口，由服务端按策略分配访问连接
+// 客户端断开之后不再分配，组内所有客户端断开之后关闭访问端口
+type ProxyGroup struct {
+	Name    string // 组名，为空时不加入负载均衡组
+	Balance string // 负载均衡策略，同一组内须相同
+	Weight  int64  // 权重，只用于按权重轮询，默认 1
+}
+
+// 是否加入负载均衡组
+func (g ProxyGroup) Enabled() bool {
+	return g.Name != ""
+}
+
+// 转字符串
+func (g ProxyGroup) String() string {
+	if !g.Enabled() {
+		return "不加入负载均衡组"
+	}
+	if g.Balance == BalanceWeighted {
+		return fmt.Sprintf("负载均衡组 %s，策略 %s，权重 %d", g.Name, g.Balance, g.Weight)
+	}
+	return fmt.Sprintf("负载均衡组 %s，策略 %s", g.Name, g.Balance)
+}
+
+// 解析负载均衡组，组名为空时不加入，策略为空时轮询，权重为空时为 1
+// 组名只能包含字母、数字及 -_.
+func ParseProxyGroup(name string, balance string, weight string) (ProxyGroup, error) {
+	name = strings.TrimSpace(name)
+	balance = strings.ToLower(strings.TrimSpace(balance))
+	if name == "" {
+		if balance != "" || strings.TrimSpace(weight) != "" {
+			return ProxyGroup{}, errors.New("负载均衡策略及权重需要同时指定组名")
+		}
+		return ProxyGroup{}, nil
+	}
+	if len(name) > maxGroupNameLength || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+		return ProxyGroup{}, fmt.Errorf("负载均衡组名格式不对：%s", name)
+	}
+
+	group := ProxyGroup{Name: name, Balance: balance, Weight: 1}
+	switch balance {
+	case "":
+		group.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceWeighted:
+	default:
+		return ProxyGroup{}, fmt.Errorf("负载均衡策略不支持：%s，支持 %s、%s、%s", balance, BalanceRoundRobin, BalanceLeastConn, BalanceWeighted)
+	}
+	count, err := parseCount(weight)
+	if err != nil || count > maxGroupWeight {
+		return ProxyGroup{}, fmt.Errorf("负载均衡权重格式不对：%s，范围 1-%d", weight, maxGroupWeight)
+	}
+	if count > 0 {
+		group.Weight = count
+	}
+	return group, nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 限速配置，单位为字节每秒
+type RateLimit struct {
+	Rate  int64 // 每秒字节数，为0时不限速
+	Burst int64 // 允许的突发字节数，为0时与 Rate 相同
+}
+
+// 是否限速
+func (r RateLimit) Enabled() bool {
+	return r.Rate > 0
+}
+
+// 突发字节数，未配置时与 Rate 相同
+func (r RateLimit) BurstOrRate() int64 {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Rate
+}
+
+// 转字符串
+func (r RateLimit) String() string {
+	if !r.Enabled() {
+		return "不限速"
+	}
+	return fmt.Sprintf("%s/s(%s)", FormatByteSize(r.Rate), FormatByteSize(r.BurstOrRate()))
+}
+
+// 解析限速，rate 为空时不限速
+func ParseRateLimit(rate string, burst string) (RateLimit, error) {
+	var limit RateLimit
+	var err error
+	if limit.Rate, err = ParseByteSize(rate); err != nil {
+		return RateLimit{}, fmt.Errorf("限速格式不对：%s", rate)
+	}
+	if limit.Burst, err = ParseByteSize(burst); err != nil {
+		return RateLimit{}, fmt.Errorf("突发流量格式不对：%s", burst)
+	}
+	return limit, nil
+}
+
+// 字节数单位，按 1024 进制
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"gb", 1 << 30}, {"g", 1 << 30},
+	{"mb", 1 << 20}, {"m", 1 << 20},
+	{"kb", 1 << 10}, {"k", 1 << 10},
+	{"b", 1},
+}
+
+// 解析字节数，支持 K、M、G 单位，如 512K、10MB，为空时返回0
+func ParseByteSize(str string) (int64, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if str == "" {
+		return 0, nil
+	}
+
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str, unit = strings.TrimSpace(strings.TrimSuffix(str, u.suffix)), u.size
+			break
+		}
+	}
+	// 非数字及超出范围的值转换结果不确定，可能为负数，视为格式不对
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) || value*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("字节数格式不对：%s", str)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// 格式化字节数
+func FormatByteSize(size int64) string {
+	for _, u := range byteSizeUnits {
+		if u.size > 1 && len(u.suffix) == 2 && size >= u.size && size%u.size == 0 {
+			return strconv.FormatInt(size/u.size, 10) + strings.ToUpper(u.suffix)
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 吊销列表文件头部的说明
+const revocationFileHeader = "# 已吊销的密钥编号，每行一个，# 开头为注释\n"
+
+// 读取吊销列表文件，每行一个密钥编号，文件不存在时返回空列表
+func LoadRevocationList(path string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	return ids, scanner.Err()
+}
+
+// 保存吊销列表文件，先写入临时文件再替换，避免读取到不完整的文件
+func SaveRevocationList(path string, ids map[string]bool) error {
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	var buf bytes.Buffer
+	buf.WriteString(revocationFileHeader)
+	for _, id := range sorted {
+		buf.WriteString(id)
+		buf.WriteByte('\n')
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
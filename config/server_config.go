@@ -1,16 +1,138 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"net"
 	"strings"
+	"time"
 )
 
 // 服务端配置
 type ServerConfig struct {
-	Key          string // 6-16 个字符，用于身份校验
-	Port         uint32 // 服务端口
-	MinProxyPort uint32 // 最小访问端口，最小值 1024
-	MaxProxyPort uint32 // 最大访问端口，最大值 65535
+	Key          string          // 6-16 个字符，用于身份校验
+	Port         uint32          // 服务端口
+	BindAddr     string          // 桥接端口监听地址，为空时监听所有地址
+	MinProxyPort uint32          // 最小访问端口，最小值 1024
+	MaxProxyPort uint32          // 最大访问端口，最大值 65535
+	TLS          TLSConfig       // 桥接端口TLS配置
+	HTTPPort     uint32          // HTTP域名代理共享端口，为0时不启用
+	HTTPSPort    uint32          // HTTPS域名代理共享端口，按 SNI 转发，为0时不启用
+	Heartbeat    HeartbeatConfig // 心跳配置
+	DrainTimeout time.Duration   // 优雅停止时等待进行中的连接完成的超时时间
+	AdminAddr    string          // 管理接口监听地址，为空时不启用
+	AdminToken   string          // 管理接口访问令牌，为空时不校验，管理接口监听非本机地址时必须配置
+	MetricsAddr  string          // 监控指标端口监听地址，为空时不启用
+	MetricsToken string          // 监控指标访问令牌，为空时不校验，监控指标端口监听非本机地址时必须配置
+	// 代理端口及域名代理共享端口的监听地址，为空时监听所有地址，客户端只能在为空时指定其他监听地址
+	ProxyBindAddr string
+	// 密钥吊销列表文件，修改后自动重新加载，为空时吊销列表只保存在内存中
+	RevocationFile string
+	// 只允许挑战应答认证，拒绝握手时发送密钥的旧版客户端及旧版密钥，证书认证的客户端不受影响
+	ChallengeAuthOnly bool
+	// 客户端凭据，key 为客户端编号，配置了的访问端口及域名归该客户端所有
+	Credentials map[string]ClientCredential
+
+	// 每个客户端的默认限速，同一密钥或者证书身份的所有代理共享
+	ClientRateLimit RateLimit
+	// 单独配置的客户端限速，key 由 ClientLimitIdentity 生成
+	ClientRateLimits map[string]RateLimit
+	// 每个客户端的默认连接数限制，同一密钥或者证书身份的所有代理共享
+	ClientConnLimit ConnLimit
+	// 单独配置的客户端连接数限制，key 由 ClientLimitIdentity 生成
+	ClientConnLimits map[string]ConnLimit
+
+	// 所有代理端口的访问地址过滤，包括域名代理共享端口
+	IPFilter IPFilter
+	// 单独配置的代理端口访问地址过滤，与 IPFilter 同时生效
+	PortIPFilters map[uint32]IPFilter
+}
+
+// 默认优雅停止超时时间
+const DefaultDrainTimeout = 30 * time.Second
+
+// 客户端限速的标识，证书认证的客户端使用证书身份，客户端凭据使用客户端编号，否则使用密钥的公开部分
+func ClientLimitIdentity(identity string, key string) string {
+	if identity != "" {
+		return "identity:" + identity
+	}
+	if id, ok := CredentialID(key); ok {
+		return "identity:" + id
+	}
+	return "key:" + KeyToken(key)
+}
+
+// 检查密钥的公开部分是否有效，返回密钥声明，支持客户端凭据，不校验客户端是否持有完整的密钥
+func (c *ServerConfig) CheckKeyToken(token string) (KeyClaims, bool) {
+	if id, ok := CredentialID(token); ok {
+		credential, exists := c.Credentials[id]
+		return credential.Claims(), exists
+	}
+	return CheckKeyToken(c.Key, token)
+}
+
+// 由密钥的公开部分推导计算证明的密文，支持客户端凭据，无法推导时返回空
+func (c *ServerConfig) KeySecret(token string) []byte {
+	if id, ok := CredentialID(token); ok {
+		if credential, exists := c.Credentials[id]; exists {
+			return []byte(credential.Secret)
+		}
+		return nil
+	}
+	return KeySecret(c.Key, token)
+}
+
+// 访问端口是否归其他客户端所有，clientID 为密钥声明的客户端编号
+func (c *ServerConfig) PortReserved(port uint32, clientID string) bool {
+	for id, credential := range c.Credentials {
+		if id != clientID && len(credential.PortRanges) > 0 && credential.Claims().AllowPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 负载均衡组的访问端口是否归其他客户端所有
+// 多个客户端凭据都配置了该端口时，这些客户端可以通过负载均衡组共享
+func (c *ServerConfig) GroupPortReserved(port uint32, clientID string) bool {
+	return !c.CredentialOwnsPort(port, clientID) && c.PortReserved(port, clientID)
+}
+
+// 客户端凭据是否配置了该访问端口，clientID 不是客户端凭据时返回 false
+func (c *ServerConfig) CredentialOwnsPort(port uint32, clientID string) bool {
+	credential, exists := c.Credentials[clientID]
+	return exists && len(credential.PortRanges) > 0 && credential.Claims().AllowPort(port)
+}
+
+// 访问域名是否归其他客户端所有，clientID 为密钥声明的客户端编号
+func (c *ServerConfig) DomainReserved(domain string, clientID string) bool {
+	for id, credential := range c.Credentials {
+		if id != clientID && len(credential.Domains) > 0 && credential.Claims().AllowDomain(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端的限速，未单独配置时使用默认限速
+func (c *ServerConfig) ClientRateLimitOf(identity string, key string) RateLimit {
+	if limit, exists := c.ClientRateLimits[ClientLimitIdentity(identity, key)]; exists {
+		return limit
+	}
+	return c.ClientRateLimit
+}
+
+// 客户端的连接数限制，未单独配置时使用默认限制
+func (c *ServerConfig) ClientConnLimitOf(identity string, key string) ConnLimit {
+	if limit, exists := c.ClientConnLimits[ClientLimitIdentity(identity, key)]; exists {
+		return limit
+	}
+	return c.ClientConnLimit
+}
+
+// 访问地址是否可以访问代理端口，须同时通过所有端口及该端口的过滤
+func (c *ServerConfig) IPAllowed(port uint32, ip net.IP) bool {
+	return c.IPFilter.Allowed(ip) && c.PortIPFilters[port].Allowed(ip)
 }
 
 // 检查端口是否在允许范围内，不含边界
@@ -58,33 +180,122 @@ func parseServerConfig(args []string) ServerConfig {
 		Port:         port,
 		MinProxyPort: minProxyPort,
 		MaxProxyPort: maxProxyPort,
+		Heartbeat:    DefaultHeartbeatConfig(),
+		DrainTimeout: DefaultDrainTimeout,
 	}
 }
 
 // 从配置文件中加载配置
 func loadServerConfig() ServerConfig {
-	if !checkPort(Config.Server.Port) {
-		log.Fatalln("端口号配置错误。", Config.Server.Port)
+	config, err := serverConfigFromYaml(Config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return config
+}
+
+// 检查并转换配置文件中的服务端配置
+func serverConfigFromYaml(yamlConfig *Yaml) (ServerConfig, error) {
+	server := yamlConfig.Server
+	if !checkPort(server.Port) {
+		return ServerConfig{}, fmt.Errorf("端口号配置错误。%d", server.Port)
+	}
+
+	if !checkPort(server.MinProxyPort) {
+		return ServerConfig{}, fmt.Errorf("最小访问端口号配置错误。%d", server.MinProxyPort)
+	}
+
+	if !checkPort(server.MaxProxyPort) {
+		return ServerConfig{}, fmt.Errorf("最大访问端口配置错误。%d", server.MaxProxyPort)
+	}
+
+	if server.MaxProxyPort < server.MinProxyPort+2 {
+		return ServerConfig{}, fmt.Errorf("访问端口号范围错误。%d %d", server.MinProxyPort, server.MaxProxyPort)
+	}
+
+	if server.HTTPPort != 0 && !checkPort(server.HTTPPort) {
+		return ServerConfig{}, fmt.Errorf("HTTP端口号配置错误。%d", server.HTTPPort)
+	}
+	if server.HTTPSPort != 0 && !checkPort(server.HTTPSPort) {
+		return ServerConfig{}, fmt.Errorf("HTTPS端口号配置错误。%d", server.HTTPSPort)
+	}
+
+	clientRateLimit, clientRateLimits, err := server.RateLimit.toRateLimits()
+	if err != nil {
+		return ServerConfig{}, fmt.Errorf("限速配置错误。%w", err)
+	}
+
+	clientConnLimit, clientConnLimits := server.ConnLimit.toConnLimits()
+
+	bindAddr, err := ParseBindAddr(server.BindAddr)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	proxyBindAddr, err := ParseBindAddr(server.ProxyBindAddr)
+	if err != nil {
+		return ServerConfig{}, err
 	}
 
-	if !checkPort(Config.Server.MinProxyPort) {
-		log.Fatalln("最小访问端口号配置错误。", Config.Server.MinProxyPort)
+	credentials, err := toClientCredentials(server.Clients)
+	if err != nil {
+		return ServerConfig{}, fmt.Errorf("客户端凭据配置错误。%w", err)
 	}
 
-	if !checkPort(Config.Server.MaxProxyPort) {
-		log.Fatalln("最大访问端口配置错误。", Config.Server.MaxProxyPort)
+	ipFilter, portIPFilters, err := server.IPFilter.toIPFilters()
+	if err != nil {
+		return ServerConfig{}, fmt.Errorf("访问地址过滤配置错误。%w", err)
 	}
 
-	if Config.Server.MaxProxyPort-Config.Server.MinProxyPort < 2 {
-		log.Fatalln("访问端口号范围错误。", Config.Server.MinProxyPort, Config.Server.MaxProxyPort)
+	drainTimeout := DefaultDrainTimeout
+	if server.DrainTimeout != 0 {
+		drainTimeout = time.Duration(server.DrainTimeout) * time.Second
 	}
 
 	return ServerConfig{
-		Key:          Config.Server.Key,
-		Port:         Config.Server.Port,
-		MinProxyPort: Config.Server.MinProxyPort,
-		MaxProxyPort: Config.Server.MaxProxyPort,
+		Key:          server.Key,
+		Port:         server.Port,
+		BindAddr:     bindAddr,
+		MinProxyPort: server.MinProxyPort,
+		MaxProxyPort: server.MaxProxyPort,
+		TLS:          server.TLS.toTLSConfig(),
+		HTTPPort:     server.HTTPPort,
+		HTTPSPort:    server.HTTPSPort,
+		Heartbeat:    server.Heartbeat.toHeartbeatConfig(),
+		DrainTimeout: drainTimeout,
+		AdminAddr:    strings.TrimSpace(server.Admin.Addr),
+		AdminToken:   server.Admin.Token,
+		MetricsAddr:  strings.TrimSpace(server.MetricsAddr),
+		MetricsToken: server.MetricsToken,
+
+		ProxyBindAddr:  proxyBindAddr,
+		RevocationFile: strings.TrimSpace(server.RevocationFile),
+
+		ChallengeAuthOnly: server.ChallengeAuthOnly,
+		Credentials:       credentials,
+
+		ClientRateLimit:  clientRateLimit,
+		ClientRateLimits: clientRateLimits,
+		ClientConnLimit:  clientConnLimit,
+		ClientConnLimits: clientConnLimits,
+
+		IPFilter:      ipFilter,
+		PortIPFilters: portIPFilters,
+	}, nil
+}
+
+// 重新读取配置文件中的服务端配置，配置有误时返回错误，不影响当前配置
+func ReloadServerConfig() (ServerConfig, error) {
+	yamlConfig, err := readConfigFile()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	config, err := serverConfigFromYaml(yamlConfig)
+	if err != nil {
+		return ServerConfig{}, err
 	}
+	Config = yamlConfig
+	serverConfig = config
+	return config, nil
 }
 
 // 初始化服务端配置，支持从参数中读取或者从配置文件中读取
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLS配置
+type TLSConfig struct {
+	Enable             bool   // 客户端是否启用TLS，配置了CA证书或者客户端证书时同样启用；服务端配置了证书和私钥即启用
+	CertFile           string // 证书文件，客户端配置时作为客户端证书
+	KeyFile            string // 私钥文件
+	CAFile             string // CA证书文件，用于校验对端证书，为空则使用系统根证书
+	ServerName         string // 客户端校验的服务端名称，默认为服务端地址
+	InsecureSkipVerify bool   // 客户端不校验服务端证书，仅用于测试
+	ClientAuth         bool   // 服务端强制要求客户端证书，否则仅在客户端提供时校验
+}
+
+// 服务端是否启用TLS
+func (c *TLSConfig) ServerEnabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// 客户端是否启用TLS，配置了客户端证书时需使用TLS才能出示证书，因此同样启用
+func (c *TLSConfig) ClientEnabled() bool {
+	return c.Enable || c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// 加载CA证书
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, errors.New("CA证书格式错误：" + caFile)
+	}
+	return pool, nil
+}
+
+// 服务端TLS配置
+func (c *TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	// 配置了CA证书，校验客户端证书
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.ClientAuth {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.ClientAuth {
+		return nil, errors.New("强制客户端证书认证需要配置CA证书")
+	}
+	return tlsConfig, nil
+}
+
+// 客户端TLS配置
+func (c *TLSConfig) ClientTLSConfig(serverHost string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverHost
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	// 客户端证书，证书和私钥须同时配置，避免未出示证书而改用密钥认证
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("客户端证书和私钥须同时配置")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// 使用命令行参数覆盖TLS配置
+func (c *TLSConfig) Override(args TLSConfig) {
+	if args.Enable {
+		c.Enable = true
+	}
+	if args.CertFile != "" {
+		c.CertFile = args.CertFile
+	}
+	if args.KeyFile != "" {
+		c.KeyFile = args.KeyFile
+	}
+	if args.CAFile != "" {
+		c.CAFile = args.CAFile
+	}
+	if args.ServerName != "" {
+		c.ServerName = args.ServerName
+	}
+	if args.ClientAuth {
+		c.ClientAuth = true
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// 定时检查配置文件的修改时间，文件被修改时发送通知，done 关闭时停止检查
+func WatchConfigFile(interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	configFilePath, err := ConfigFilePath()
+	if err != nil {
+		log.Println("监听配置文件失败！", err)
+		return make(chan struct{}, 1)
+	}
+	return WatchFile(configFilePath, interval, done)
+}
+
+// 定时检查文件的修改时间，文件被修改时发送通知，done 关闭时停止检查
+func WatchFile(path string, interval time.Duration, done <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	lastModTime := modTime(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if t := modTime(path); !t.IsZero() && !t.Equal(lastModTime) {
+					lastModTime = t
+					select {
+					case changed <- struct{}{}:
+					default:
+						// 上次的通知尚未处理
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return changed
+}
+
+// 文件修改时间，文件不存在时返回零值
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
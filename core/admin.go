@@ -0,0 +1,367 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/aulang/netbus/config"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 管理接口
+// GET    /api/tunnels        查看所有代理通道，域名代理及负载均衡组成员的端口为共享的访问端口，另有虚拟端口
+// DELETE /api/tunnels/{port} 关闭代理通道，域名代理及负载均衡组成员使用虚拟端口
+// GET    /api/clients        查看所有客户端会话，旧版客户端没有会话，只出现在代理通道中
+// DELETE /api/clients/{id}   断开客户端会话，客户端会自动重连
+// GET    /api/revocations           查看已吊销的密钥编号
+// PUT    /api/revocations/{key_id}  吊销密钥，断开使用该密钥的客户端，key_id 与客户端信息中的相同
+// DELETE /api/revocations/{key_id}  取消吊销密钥
+
+// 客户端信息
+type adminClient struct {
+	ID           uint64     `json:"id,omitempty"` // 会话编号，旧版客户端为0
+	Legacy       bool       `json:"legacy,omitempty"`
+	RemoteAddr   string     `json:"remote_addr"`
+	Identity     string     `json:"identity,omitempty"`    // 客户端证书身份
+	KeyID        string     `json:"key_id,omitempty"`      // 密钥编号，旧版密钥、超级密钥及客户端凭据为空
+	KeyExpiry    string     `json:"key_expiry,omitempty"`  // 密钥过期时间，超级密钥及证书认证为空
+	ClientID     string     `json:"client_id,omitempty"`   // 密钥声明的客户端编号
+	KeyPorts     string     `json:"key_ports,omitempty"`   // 密钥允许的访问端口范围
+	KeyDomains   []string   `json:"key_domains,omitempty"` // 客户端凭据允许的访问域名
+	KeyTypes     []string   `json:"key_types,omitempty"`   // 密钥允许的代理类型
+	Capabilities []string   `json:"capabilities,omitempty"`
+	ConnectedAt  *time.Time `json:"connected_at,omitempty"`
+	Tunnels      []uint32   `json:"tunnels,omitempty"`
+}
+
+// 代理通道信息
+type adminTunnel struct {
+	Port        uint32      `json:"port"`                   // 访问端口
+	VirtualPort uint32      `json:"virtual_port,omitempty"` // 域名代理及负载均衡组成员的虚拟端口，用于关闭通道
+	Type        string      `json:"type"`
+	Name        string      `json:"name,omitempty"`
+	Domains     []string    `json:"domains,omitempty"`
+	BindAddr    string      `json:"bind_addr,omitempty"`
+	Group       *adminGroup `json:"group,omitempty"` // 所属负载均衡组
+	Client      adminClient `json:"client"`
+	IdleConns   int64       `json:"idle_conns"`
+	ActiveConns int64       `json:"active_conns"`
+	BytesIn     int64       `json:"bytes_in"`
+	BytesOut    int64       `json:"bytes_out"`
+	Rejected    int64       `json:"rejected_conns"`
+	Denied      int64       `json:"denied_conns"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// 负载均衡组成员信息
+type adminGroup struct {
+	Name    string `json:"name"`
+	Port    uint32 `json:"port"` // 组的访问端口
+	Balance string `json:"balance"`
+	Weight  int64  `json:"weight"`
+	Conns   int64  `json:"conns"` // 分配给该成员进行中的访问连接数
+}
+
+// 启动管理接口，监听失败时返回错误
+func (s *Server) listenAdmin(addr string) (net.Listener, error) {
+	if s.config().AdminToken == "" && !loopbackAddr(addr) {
+		return nil, errors.New("管理接口监听非本机地址时须配置访问令牌")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tunnels", s.handleAdminTunnels)
+	mux.HandleFunc("/api/tunnels/", s.handleAdminTunnel)
+	mux.HandleFunc("/api/clients", s.handleAdminClients)
+	mux.HandleFunc("/api/clients/", s.handleAdminClient)
+	mux.HandleFunc("/api/revocations", s.handleAdminRevocations)
+	mux.HandleFunc("/api/revocations/", s.handleAdminRevocation)
+	s.admin = &http.Server{Handler: s.checkAdminToken(mux)}
+	return listener, nil
+}
+
+// 受理管理接口请求
+func (s *Server) serveAdmin(listener net.Listener) {
+	defer s.wg.Done()
+	log.Printf("正在监听管理接口：[%s]\n", listener.Addr())
+
+	if err := s.admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println("管理接口已停止！", err)
+	}
+}
+
+// 是否为只能从本机访问的监听地址，监听所有地址时返回 false
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// 校验访问令牌，未配置令牌时不校验，只有管理接口监听本机地址时才能不配置令牌
+func (s *Server) checkAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.config().AdminToken
+		if token != "" {
+			provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				writeAdminError(w, http.StatusUnauthorized, "访问令牌错误")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 查看所有代理通道
+func (s *Server) handleAdminTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+
+	cfg := s.config()
+	tunnels := make([]adminTunnel, 0)
+	s.tunnels.Range(func(key, value interface{}) bool {
+		tunnels = append(tunnels, value.(*ClientTunnel).adminInfo(cfg.Key))
+		return true
+	})
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].Port != tunnels[j].Port {
+			return tunnels[i].Port < tunnels[j].Port
+		}
+		return tunnels[i].VirtualPort < tunnels[j].VirtualPort
+	})
+	writeAdminJSON(w, http.StatusOK, tunnels)
+}
+
+// 关闭代理通道
+func (s *Server) handleAdminTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+
+	port, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/tunnels/"), 10, 32)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "端口号格式不对")
+		return
+	}
+	value, exists := s.tunnels.Load(uint32(port))
+	if !exists {
+		writeAdminError(w, http.StatusNotFound, "代理通道不存在")
+		return
+	}
+
+	tunnel := value.(*ClientTunnel)
+	log.Printf("管理接口关闭代理通道：[%d]，请求地址：[%s]\n", port, r.RemoteAddr)
+	if tunnel.session != nil {
+		tunnel.session.removeTunnel(tunnel.protocol.Port)
+	} else {
+		tunnel.close()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 查看所有客户端会话
+func (s *Server) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+
+	clients := make([]adminClient, 0)
+	s.sessions.Range(func(key, value interface{}) bool {
+		clients = append(clients, key.(*clientSession).adminInfo(true))
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	writeAdminJSON(w, http.StatusOK, clients)
+}
+
+// 断开客户端会话
+func (s *Server) handleAdminClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/clients/"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "会话编号格式不对")
+		return
+	}
+
+	var session *clientSession
+	s.sessions.Range(func(key, value interface{}) bool {
+		if key.(*clientSession).id == id {
+			session = key.(*clientSession)
+			return false
+		}
+		return true
+	})
+	if session == nil {
+		writeAdminError(w, http.StatusNotFound, "客户端会话不存在")
+		return
+	}
+
+	log.Printf("管理接口断开客户端：[%s]，请求地址：[%s]\n", session.String(), r.RemoteAddr)
+	session.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 查看已吊销的密钥编号
+func (s *Server) handleAdminRevocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, s.revocations.list())
+}
+
+// 吊销密钥或者取消吊销
+func (s *Server) handleAdminRevocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "不支持的请求方法")
+		return
+	}
+
+	id := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/revocations/"))
+	if id == "" || strings.ContainsAny(id, "/#\r\n") {
+		writeAdminError(w, http.StatusBadRequest, "密钥编号格式不对")
+		return
+	}
+
+	revoke := r.Method == http.MethodPut
+	changed, err := s.setRevoked(id, revoke)
+	if err != nil {
+		log.Println("保存密钥吊销列表失败！", err)
+		writeAdminError(w, http.StatusInternalServerError, "保存密钥吊销列表失败")
+		return
+	}
+	if !changed {
+		writeAdminError(w, http.StatusNotFound, "密钥未吊销")
+		return
+	}
+
+	if revoke {
+		log.Printf("管理接口吊销密钥：[%s]，请求地址：[%s]\n", id, r.RemoteAddr)
+	} else {
+		log.Printf("管理接口取消吊销密钥：[%s]，请求地址：[%s]\n", id, r.RemoteAddr)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 代理通道信息
+func (t *ClientTunnel) adminInfo(serverKey string) adminTunnel {
+	info := adminTunnel{
+		Port:        t.proxyPort(),
+		Type:        t.proxyType,
+		Name:        t.name,
+		Domains:     t.domains,
+		BindAddr:    t.bindAddr,
+		IdleConns:   atomic.LoadInt64(&t.stats.idleConns),
+		ActiveConns: atomic.LoadInt64(&t.stats.activeConns),
+		BytesIn:     atomic.LoadInt64(&t.stats.bytesIn),
+		BytesOut:    atomic.LoadInt64(&t.stats.bytesOut),
+		Rejected:    atomic.LoadInt64(&t.stats.rejectedConns),
+		Denied:      atomic.LoadInt64(&t.stats.deniedConns),
+		CreatedAt:   t.createdAt,
+	}
+	if t.virtual() {
+		info.VirtualPort = t.protocol.Port
+	}
+	if t.group != nil {
+		info.BindAddr = t.group.bindAddr
+		if member := t.group.member(t); member != nil {
+			info.Group = &adminGroup{
+				Name:    t.group.name,
+				Port:    t.group.port,
+				Balance: t.group.balance,
+				Weight:  member.weight,
+				Conns:   member.conns,
+			}
+		}
+	}
+	if t.session != nil {
+		info.Client = t.session.adminInfo(false)
+		return info
+	}
+
+	// 旧版客户端
+	info.Client = adminClient{
+		Legacy:   true,
+		Identity: t.identity,
+	}
+	if t.identity == "" {
+		claims, _ := config.ParseKey(serverKey, t.protocol.Key)
+		info.Client.KeyID = claims.ID
+		info.Client.setClaims(claims)
+	}
+	if t.remoteAddr != nil {
+		info.Client.RemoteAddr = t.remoteAddr.String()
+	}
+	return info
+}
+
+// 客户端会话信息，withTunnels 为 true 时包含已注册的代理通道
+func (s *clientSession) adminInfo(withTunnels bool) adminClient {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	connectedAt := s.connectedAt
+	info := adminClient{
+		ID:           s.id,
+		RemoteAddr:   s.session.RemoteAddr().String(),
+		Identity:     s.identity,
+		KeyID:        s.claims.ID,
+		Capabilities: s.capabilities,
+		ConnectedAt:  &connectedAt,
+	}
+	info.setClaims(s.claims)
+	if withTunnels {
+		for _, tunnel := range s.tunnels {
+			info.Tunnels = append(info.Tunnels, tunnel.protocol.Port)
+		}
+	}
+	return info
+}
+
+// 设置密钥声明，证书认证及超级密钥没有声明
+func (c *adminClient) setClaims(claims config.KeyClaims) {
+	if !claims.ExpiresAt.IsZero() {
+		c.KeyExpiry = claims.ExpiresAt.Format(time.RFC3339)
+	}
+	c.ClientID = claims.ClientID
+	c.KeyPorts = config.FormatPortRanges(claims.PortRanges)
+	c.KeyDomains = claims.Domains
+	c.KeyTypes = claims.ProxyTypes
+}
+
+// 返回JSON数据
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+// 返回错误信息
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// 挑战应答认证，版本4开始使用，密钥不在网络中传输
+// 客户端：{"result":1,"version":4,"port":0,"capabilities":["udp"]}
+// 服务端：{"result":8,"version":4,"nonce":"...","timestamp":1700000000}
+// 客户端：{"result":1,"version":4,"port":0,"capabilities":["udp"],"token":"v3.xxx","proof":"..."}
+// 服务端：握手结果
+// 证明为 HMAC-SHA256(密文, 随机数|签发时间|访问端口|公开部分)，每条连接的随机数不同，超时之后失效，无法重放
+// 新版密钥只发送公开部分，密文由服务端通过种子推导；超级密钥不发送公开部分，密文为种子本身
+// 客户端凭据的公开部分为 client:客户端编号，密文为服务端配置的该客户端密钥
+// 旧版密钥无法由服务端推导密文，仍按版本3发送密钥
+// 认证只在控制连接上进行一次，同一会话中不含密钥的工作连接随会话认证，不再挑战
+
+const (
+	authNonceLength      = 16               // 认证挑战随机数的字节数
+	authChallengeTimeout = 30 * time.Second // 认证挑战的有效时间
+)
+
+// 计算认证挑战的证明
+func authProof(secret []byte, nonce string, timestamp int64, port uint32, token string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "netbus-auth|%s|%d|%d|%s", nonce, timestamp, port, token)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 发送认证挑战并接收带证明的请求，证明正确时返回的请求已通过认证
+// 证明错误时返回的请求不含密钥，由 checkProtocol 按认证失败处理
+func (s *Server) challenge(conn net.Conn, hello Protocol) Protocol {
+	nonce := make([]byte, authNonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Println("生成认证挑战失败！", err)
+		return Protocol{Result: protocolResultFailToReceive}
+	}
+	issuedAt := time.Now()
+	challenge := hello.NewResult(protocolResultChallenge)
+	challenge.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	challenge.Timestamp = issuedAt.Unix()
+	if !sendProtocol(conn, challenge) {
+		return Protocol{Result: protocolResultFailToReceive}
+	}
+
+	// 未在有效时间内应答的连接直接断开，避免未认证的连接一直占用
+	_ = conn.SetReadDeadline(issuedAt.Add(authChallengeTimeout))
+	protocol := receiveProtocol(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if protocol.Result != protocolResultSuccess || protocol.legacy {
+		return protocol
+	}
+	if time.Since(issuedAt) > authChallengeTimeout {
+		log.Println("认证挑战已超时！", protocol.String())
+		return protocol
+	}
+
+	// 公开部分为空时为超级密钥
+	cfg := s.config()
+	key := protocol.Token
+	if key == "" {
+		key = cfg.Key
+	}
+	secret := cfg.KeySecret(protocol.Token)
+	expected := authProof(secret, challenge.Nonce, challenge.Timestamp, protocol.Port, protocol.Token)
+	if secret == nil || !hmac.Equal([]byte(protocol.Proof), []byte(expected)) {
+		log.Println("认证证明错误！", protocol.String())
+		return protocol
+	}
+	protocol.Key = key
+	protocol.proven = true
+	return protocol
+}
+
+// 是否需要挑战应答认证，证书认证的客户端无需密钥
+func needChallenge(protocol Protocol, identity string) bool {
+	return identity == "" && !protocol.legacy && protocol.Result == protocolResultSuccess &&
+		protocol.Version >= protocolVersion && protocol.Key == ""
+}
+
+// 是否为随会话认证的工作连接，新版客户端的工作连接不发送密钥
+func isSessionWorkConn(protocol Protocol) bool {
+	return !protocol.legacy && protocol.Result == protocolResultSuccess &&
+		protocol.Version >= protocolVersion && protocol.Port != 0 && protocol.Key == ""
+}
+
+// 客户端应答认证挑战，发送带证明的请求
+func answerChallenge(conn net.Conn, request Protocol, challenge Protocol, secret []byte) bool {
+	request.Proof = authProof(secret, challenge.Nonce, challenge.Timestamp, request.Port, request.Token)
+	return sendProtocol(conn, request)
+}
@@ -1,123 +1,644 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/aulang/netbus/config"
+	"github.com/hashicorp/yamux"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 )
 
-// 发送代理请求
-func sendProxyRequest(conn net.Conn, key string, port uint32) bool {
+// 代理请求，控制连接同时发送客户端支持的功能
+// 密钥支持挑战应答认证时不包含密钥，旧版密钥按版本3发送密钥，返回计算证明的密文
+// clientID 不为空时使用服务端的客户端凭据，key 为凭据中的密钥
+func proxyRequest(key string, clientID string, port uint32) (Protocol, []byte) {
 	request := Protocol{
 		Result:  protocolResultSuccess,
 		Version: protocolVersion,
 		Port:    port,
-		Key:     key,
 	}
+	if port == 0 {
+		request.Capabilities = clientCapabilities
+	}
+
+	if clientID != "" {
+		request.Token = config.CredentialToken(clientID)
+		return request, []byte(key)
+	}
+	token, secret, ok := config.SplitKey(key)
+	if !ok {
+		request.Version = protocolVersionFrame
+		request.Key = key
+		return request, nil
+	}
+	request.Token = token
+	return request, secret
+}
 
-	return sendProtocol(conn, request)
+// 发送代理请求并等待服务端响应，服务端返回认证挑战时发送证明
+// 版本不匹配或者认证失败时返回 ErrVersionMismatch、ErrAuthFailed，重连也无法成功
+func handshake(conn net.Conn, key string, clientID string, port uint32) (Protocol, error) {
+	// 请求建立连接
+	request, secret := proxyRequest(key, clientID, port)
+	if !sendProtocol(conn, request) {
+		return Protocol{}, errors.New("发送协议数据失败")
+	}
+
+	// 等待服务器端响应
+	protocol := receiveProtocol(conn)
+	if protocol.Result == protocolResultChallenge && request.Key == "" {
+		if !answerChallenge(conn, request, protocol, secret) {
+			return Protocol{}, errors.New("发送协议数据失败")
+		}
+		protocol = receiveProtocol(conn)
+	}
+
+	// 处理连接结果
+	switch protocol.Result {
+	case protocolResultSuccess:
+		return protocol, nil
+	case protocolResultVersionMismatch:
+		closeWithoutError(conn)
+		return protocol, fmt.Errorf("%w：[%s]", ErrVersionMismatch, protocol.Reason())
+	case protocolResultFailToAuth:
+		closeWithoutError(conn)
+		// 旧版服务端不支持挑战应答认证，按未发送密钥处理
+		if request.Key == "" && protocol.Version < protocolVersion {
+			return protocol, fmt.Errorf("%w：[服务端不支持挑战应答认证，请升级服务端]", ErrVersionMismatch)
+		}
+		return protocol, fmt.Errorf("%w：[%s]", ErrAuthFailed, protocol.Reason())
+	default:
+		return protocol, fmt.Errorf("连接服务端失败：[%s]", protocol.Reason())
+	}
+}
+
+// 客户端，可在同一进程中创建多个
+type Client struct {
+	cfg       config.ClientConfig // 重新加载时更新，与 tlsConfig 一起受 mutex 保护
+	tlsConfig *tls.Config         // 连接服务端的TLS配置，未启用时为空
+
+	reload      chan []config.NetAddress // 重新加载的代理映射，由当前会话处理
+	reloadMutex sync.Mutex
+
+	metrics       *metrics     // 握手、拨号及各访问端口的统计，未启用监控指标时为空
+	metricsServer *http.Server // 监控指标端口，未启用时为空
+
+	mutex    sync.Mutex
+	session  *yamux.Session // 当前与服务端的会话
+	started  bool
+	done     chan struct{} // 客户端停止通知
+	exited   chan struct{} // 重连循环已退出
+	stopOnce sync.Once
+	err      error // 导致客户端停止的错误
+}
+
+// 创建客户端
+func NewClient(cfg config.ClientConfig) *Client {
+	cfg.Heartbeat.SetDefaults()
+	client := &Client{
+		cfg:    cfg,
+		reload: make(chan []config.NetAddress, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	if cfg.MetricsAddr != "" {
+		client.metrics = newMetrics()
+	}
+	return client
+}
+
+// 启动客户端，在后台连接服务端并注册代理，会话断开之后自动重连
+// ctx 取消时停止客户端
+func (c *Client) Start(ctx context.Context) error {
+	log.Println("加载配置：", c.cfg)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.started {
+		return errors.New("客户端已启动")
+	}
+	if err := c.cfg.Heartbeat.Check(); err != nil {
+		return fmt.Errorf("心跳配置错误：%w", err)
+	}
+	if c.cfg.ClientID == "" && config.KeyFormatDeprecated(c.cfg.Key) {
+		return errors.New("密钥格式已废弃，服务端不再接受，请使用 -generate 重新创建密钥")
+	}
+
+	// 连接服务端的TLS配置
+	if c.cfg.TLS.ClientEnabled() {
+		var err error
+		if c.tlsConfig, err = c.cfg.TLS.ClientTLSConfig(c.cfg.ServerAddr.Host); err != nil {
+			return fmt.Errorf("加载TLS配置失败：%w", err)
+		}
+		log.Println("已启用TLS加密连接服务端")
+	}
+
+	// 监控指标端口
+	if c.cfg.MetricsAddr != "" {
+		var listener net.Listener
+		var err error
+		token := c.cfg.MetricsToken
+		if c.metricsServer, listener, err = listenMetrics(c.cfg.MetricsAddr, func() string { return token }, c.writeMetrics); err != nil {
+			return fmt.Errorf("监听监控指标端口失败：[%s]，%w", c.cfg.MetricsAddr, err)
+		}
+		go serveMetrics(c.metricsServer, listener)
+	}
+
+	c.started = true
+	go c.run()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop()
+		case <-c.done:
+		}
+	}()
+	return nil
+}
+
+// 停止客户端，断开与服务端的会话，服务端随之关闭代理端口
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+
+		c.mutex.Lock()
+		if c.session != nil {
+			closeWithoutError(c.session)
+		}
+		if c.metricsServer != nil {
+			closeWithoutError(c.metricsServer)
+		}
+		c.mutex.Unlock()
+	})
 }
 
-// 打开服务端代理连接
-func buildServerTunnel(cfg config.ClientConfig, proxyAddr config.NetAddress, wg *sync.WaitGroup) {
-	flagChan := make(chan bool)
+// 停止客户端并等待重连循环退出，客户端不等待进行中的连接，会话断开时随之断开
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.Stop()
 
-	// 远程拨号，建立代理会话
-	go openProxyConn(cfg, proxyAddr, flagChan, wg)
+	c.mutex.Lock()
+	started := c.started
+	c.mutex.Unlock()
+	if !started {
+		return nil
+	}
 
-	// 初始化连接
-	for i := 0; i < cfg.TunnelCount; i++ {
-		flagChan <- true
+	select {
+	case <-c.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	log.Printf("初始化通道完成，本地端口：[%d]，服务器代理端口号：[%d]，通道数：[%d]\n",
-		proxyAddr.Port,
-		proxyAddr.ProxyPort,
-		cfg.TunnelCount)
+// 等待客户端停止，返回导致客户端停止的错误，调用 Stop 停止时返回空
+func (c *Client) Wait() error {
+	<-c.done
+	c.mutex.Lock()
+	started := c.started
+	c.mutex.Unlock()
+	if started {
+		<-c.exited
+	}
+	return c.err
 }
 
-func openProxyConn(cfg config.ClientConfig, proxyAddr config.NetAddress, flagChan chan bool, wg *sync.WaitGroup) {
-	key := cfg.Key
-	serverAddr := cfg.ServerAddr
+// 客户端是否已停止
+func (c *Client) stopped() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
 
-	for flag := range flagChan {
-		if !flag {
-			// 不再创建新桥
-			wg.Done()
+// 会话断开之后重新连接，客户端停止或者遇到无法恢复的错误时返回
+func (c *Client) run() {
+	defer close(c.exited)
+
+	for {
+		if err := c.runSession(); err != nil {
+			log.Println("客户端已停止！", err)
+			c.err = err
+			c.Stop()
+			return
+		}
+		if c.stopped() {
+			return
+		}
+		log.Printf("与服务端的连接已断开，%d秒之后重连\n", retryIntervalTime)
+		select {
+		case <-time.After(retryIntervalTime * time.Second):
+		case <-c.done:
 			return
 		}
+	}
+}
 
-		go func(serverAddr config.NetAddress, proxyAddr config.NetAddress, key string, flagChan chan bool) {
-			serverConn := dial(serverAddr, 10)
-			if serverConn == nil {
-				log.Fatalf("向服务器建立连接失败：[%s]\n", serverAddr.String())
-			}
+// 保存当前会话，客户端已停止时返回 false
+func (c *Client) setSession(session *yamux.Session) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopped() {
+		return false
+	}
+	c.session = session
+	return true
+}
+
+// 建立与服务端的多路复用会话，通过控制连接注册代理端口，会话断开时返回
+// 仅在遇到无法通过重连恢复的错误时返回错误
+func (c *Client) runSession() error {
+	c.mutex.Lock()
+	cfg, tlsConfig := c.cfg, c.tlsConfig
+	c.mutex.Unlock()
 
-			// 请求建立连接
-			if !sendProxyRequest(serverConn, key, proxyAddr.ProxyPort) {
-				log.Println("发送协议数据失败！")
-				closeWithoutError(serverConn)
-				// 重新连接
-				flagChan <- true
+	serverConn := dialTLS(cfg.ServerAddr, tlsConfig, cfg.Heartbeat.TCPKeepAlive, 1, c.metrics)
+	if serverConn == nil {
+		return nil
+	}
+
+	session, err := yamux.Client(serverConn, muxConfig(cfg.Heartbeat))
+	if err != nil {
+		log.Println("建立多路复用会话失败！", err)
+		closeWithoutError(serverConn)
+		return nil
+	}
+	defer closeWithoutError(session)
+	if !c.setSession(session) {
+		return nil
+	}
+
+	// 打开控制连接
+	stream, err := session.Open()
+	if err != nil {
+		log.Println("打开控制连接失败！", err)
+		return nil
+	}
+	result, err := handshake(stream, cfg.Key, cfg.ClientID, 0)
+	c.metrics.handshake(result.Result)
+	if err != nil {
+		if errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrAuthFailed) {
+			return err
+		}
+		log.Println(err)
+		return nil
+	}
+	control := newControlConn(stream)
+	log.Printf("已连接服务端：[%s]，协议版本：[%d]，功能：%v\n", cfg.ServerAddr.String(), result.Version, result.Capabilities)
+	if _, _, ok := config.SplitKey(cfg.Key); !ok && cfg.ClientID == "" {
+		log.Println("旧版密钥不支持挑战应答认证，握手时会发送密钥，请使用 -generate 重新创建密钥")
+	}
+
+	// 定时发送心跳，超时未收到服务端消息则断开重连
+	if hasCapability(result.Capabilities, capabilityHeartbeat) {
+		control.timeout = cfg.Heartbeat.Timeout
+		go sendHeartbeat(control, cfg.Heartbeat.Interval, session.CloseChan())
+	}
+
+	// 注册代理，会话断开时移除各访问端口的统计
+	mappings := newProxyMappings(control, result.Capabilities, c.metrics)
+	defer mappings.close()
+	for _, proxyAddr := range cfg.ProxyAddrs {
+		if !mappings.register(proxyAddr) {
+			return nil
+		}
+	}
+
+	// 接收服务端消息
+	messages := make(chan Message)
+	go func() {
+		defer close(messages)
+		for {
+			message, ok := control.receiveMessage()
+			if !ok {
+				return
+			}
+			select {
+			case messages <- message:
+			case <-session.CloseChan():
 				return
 			}
+		}
+	}()
+
+	// 处理服务端消息及重新加载的代理映射
+	for {
+		var message Message
+		var ok bool
+		select {
+		case message, ok = <-messages:
+			if !ok {
+				return nil
+			}
+		case proxyAddrs := <-c.reload:
+			if !mappings.update(proxyAddrs) {
+				return nil
+			}
+			continue
+		}
 
-			// 等待服务器端接收数据响应
-			protocol := receiveProtocol(serverConn)
-
-			// 处理连接结果
-			switch protocol.Result {
-			case protocolResultSuccess:
-				// 接收到服务器端数据，准备数据传输
-				go receiveData(proxyAddr, serverConn, flagChan)
-			case protocolResultVersionMismatch:
-				closeWithoutError(serverConn)
-				// 版本不匹配，退出客户端
-				log.Fatalln("版本不匹配！")
-			case protocolResultFailToAuth:
-				closeWithoutError(serverConn)
-				// 鉴权失败，退出客户端
-				log.Fatalln("认证失败！")
-			case protocolResultIllegalAccessPort:
-				closeWithoutError(serverConn)
-				// 访问端口不合法，退出客户端
-				log.Fatalln("端口不合法！")
-			default:
-				closeWithoutError(serverConn)
-				// 连接中断，重新连接
-				flagChan <- true
+		switch message.Type {
+		case messageRegisterResult:
+			if !mappings.registered(message) {
+				return nil
+			}
+		case messageNewConn:
+			proxyAddr, exists := mappings.ports[message.Port]
+			if !exists {
+				log.Println("未知的代理端口！", message.Port)
+				continue
 			}
-		}(serverAddr, proxyAddr, key, flagChan)
+			// 在会话中取得统计，会话断开之后不会再创建已移除的统计
+			go c.openWorkConn(session, cfg, message.Port, proxyAddr, c.metrics.portStats(message.Port, proxyAddr))
+		case messagePong:
+			// 心跳响应，接收时已刷新超时时间
+		case messageShutdown:
+			// 进行中的连接继续转发，会话断开之后重连
+			log.Printf("服务端正在停止：[%s]，进行中的连接完成之后重连\n", cfg.ServerAddr.String())
+		default:
+			log.Println("未知的控制消息！", message.Type)
+		}
 	}
 }
 
-// 本地服务连接拨号，并建立双向通道
-func receiveData(proxyAddr config.NetAddress, serverConn net.Conn, flagChan chan bool) {
-	// 建立本地连接，进行连接数据传输
-	if localConn := dial(proxyAddr, 5); localConn != nil {
-		flagChan <- true
-		forward(serverConn, localConn)
+// 当前会话的代理映射
+type proxyMappings struct {
+	control      *controlConn
+	capabilities []string // 协商后的功能
+
+	// key:   代理映射名称
+	// value: 已请求注册的代理映射
+	names map[string]config.NetAddress
+	// key:   服务端访问端口
+	// value: 注册成功的代理映射
+	ports map[uint32]config.NetAddress
+
+	metrics *metrics // 各访问端口的统计，未启用监控指标时为空
+}
+
+func newProxyMappings(control *controlConn, capabilities []string, metrics *metrics) *proxyMappings {
+	return &proxyMappings{
+		control:      control,
+		capabilities: capabilities,
+		names:        make(map[string]config.NetAddress),
+		ports:        make(map[uint32]config.NetAddress),
+		metrics:      metrics,
+	}
+}
+
+// 会话断开，移除各访问端口的统计
+func (m *proxyMappings) close() {
+	for port := range m.ports {
+		m.metrics.removePort(port)
+	}
+}
+
+// 请求注册代理，服务端不支持时忽略，发送失败时返回 false
+func (m *proxyMappings) register(proxyAddr config.NetAddress) bool {
+	if !supportsProxy(m.capabilities, proxyAddr) {
+		log.Printf("服务端不支持该代理：[%s]\n", proxyAddr.FullString())
+		return true
+	}
+	message := Message{
+		Type:      messageRegister,
+		Name:      proxyAddr.FullString(),
+		Port:      proxyAddr.ProxyPort,
+		ProxyType: proxyAddr.Type,
+		Domains:   proxyAddr.Domains,
+	}
+	if proxyAddr.RateLimit.Enabled() {
+		if hasCapability(m.capabilities, capabilityRateLimit) {
+			message.Rate, message.Burst = proxyAddr.RateLimit.Rate, proxyAddr.RateLimit.Burst
+		} else {
+			log.Printf("服务端不支持限速，代理不限速：[%s]\n", proxyAddr.FullString())
+		}
+	}
+	if proxyAddr.ConnLimit.Enabled() {
+		if hasCapability(m.capabilities, capabilityConnLimit) {
+			message.setConnLimit(proxyAddr.ConnLimit)
+		} else {
+			log.Printf("服务端不支持连接数限制，代理不限制连接数：[%s]\n", proxyAddr.FullString())
+		}
+	}
+	if proxyAddr.IPFilter.Enabled() {
+		// 不过滤访问地址会暴露给所有人，不注册该代理
+		if !hasCapability(m.capabilities, capabilityIPFilter) {
+			log.Printf("服务端不支持访问地址过滤，不注册该代理：[%s]\n", proxyAddr.FullString())
+			return true
+		}
+		message.Allow, message.Deny = proxyAddr.IPFilter.Allow, proxyAddr.IPFilter.Deny
+	}
+	if proxyAddr.ProxyProtocol != "" {
+		// 本地服务要求 PROXY protocol 头，不发送会导致访问失败
+		if !hasCapability(m.capabilities, capabilityProxyProtocol) {
+			log.Printf("服务端不支持 PROXY protocol，不注册该代理：[%s]\n", proxyAddr.FullString())
+			return true
+		}
+		message.ProxyProtocol = proxyAddr.ProxyProtocol
+	}
+	if proxyAddr.BindAddr != "" {
+		// 监听所有地址可能暴露给不应访问的网络，不注册该代理
+		if !hasCapability(m.capabilities, capabilityBindAddr) {
+			log.Printf("服务端不支持指定监听地址，不注册该代理：[%s]\n", proxyAddr.FullString())
+			return true
+		}
+		message.BindAddr = proxyAddr.BindAddr
+	}
+	if proxyAddr.Group.Enabled() {
+		if hasCapability(m.capabilities, capabilityGroup) {
+			message.setProxyGroup(proxyAddr.Group)
+		} else {
+			log.Printf("服务端不支持负载均衡组，按独占访问端口注册：[%s]\n", proxyAddr.FullString())
+		}
+	}
+	m.names[message.Name] = proxyAddr
+	return m.control.sendMessage(message)
+}
+
+// 处理注册结果，发送失败时返回 false
+func (m *proxyMappings) registered(message Message) bool {
+	proxyAddr, exists := m.names[message.Name]
+	if !exists {
+		// 等待注册结果期间已从配置中移除
+		if message.Result == protocolResultSuccess {
+			return m.control.sendMessage(Message{Type: messageUnregister, Name: message.Name, Port: message.Port})
+		}
+		log.Println("未知的代理映射！", message.Name)
+		return true
+	}
+	if message.Result != protocolResultSuccess {
+		log.Printf("注册代理失败：[%s]，原因：[%s]\n",
+			proxyAddr.FullString(),
+			protocolResultText(message.Result))
+		return true
+	}
+	m.ports[message.Port] = proxyAddr
+	if proxyAddr.Group.Enabled() && hasCapability(m.capabilities, capabilityGroup) {
+		// 注册结果中为服务端分配的虚拟端口
+		log.Printf("加入负载均衡组成功，本地服务：[%s/%s]，服务器代理端口号：[%d]，%s\n",
+			proxyAddr.Network(),
+			proxyAddr.String(),
+			proxyAddr.ProxyPort,
+			proxyAddr.Group.String())
+	} else if proxyAddr.IsDomainProxy() {
+		log.Printf("注册域名代理成功，本地服务：[%s]，访问域名：%v\n",
+			proxyAddr.String(),
+			proxyAddr.Domains)
+	} else if proxyAddr.ProxyPort == 0 {
+		log.Printf("注册代理端口成功，本地服务：[%s/%s]，服务器分配代理端口号：[%d]\n",
+			proxyAddr.Network(),
+			proxyAddr.String(),
+			message.Port)
 	} else {
-		log.Printf("本地端口 [%d] 服务已停止！\n", proxyAddr.Port)
-		// 打开本地连接失败，关闭服务器流
-		closeWithoutError(serverConn)
-		flagChan <- false
+		log.Printf("注册代理端口成功，本地服务：[%s/%s]，服务器代理端口号：[%d]\n",
+			proxyAddr.Network(),
+			proxyAddr.String(),
+			message.Port)
 	}
+	return true
 }
 
-// 入口
-func Client(cfg config.ClientConfig) {
-	log.Println("加载配置：", cfg)
+// 取消注册代理，发送失败时返回 false
+func (m *proxyMappings) unregister(name string) bool {
+	delete(m.names, name)
+	for port, proxyAddr := range m.ports {
+		if proxyAddr.FullString() != name {
+			continue
+		}
+		delete(m.ports, port)
+		m.metrics.removePort(port)
+		log.Printf("已取消注册代理：[%s]\n", name)
+		return m.control.sendMessage(Message{Type: messageUnregister, Name: name, Port: port})
+	}
+	return true
+}
 
-	var wg sync.WaitGroup
+// 按新的代理映射注册新增的代理、取消注册已移除的代理，未修改的代理不受影响
+// 服务端不支持取消注册或者发送失败时返回 false，由调用方重新连接
+func (m *proxyMappings) update(proxyAddrs []config.NetAddress) bool {
+	newNames := make(map[string]bool)
+	for _, proxyAddr := range proxyAddrs {
+		newNames[proxyAddr.FullString()] = true
+	}
 
-	// 遍历所有代理地址配置，建立代理连接
-	for _, proxyAddr := range cfg.ProxyAddrs {
-		wg.Add(1)
+	for name := range m.names {
+		if newNames[name] {
+			continue
+		}
+		if !hasCapability(m.capabilities, capabilityUnregister) {
+			log.Println("服务端不支持取消注册代理，重新连接服务端")
+			return false
+		}
+		if !m.unregister(name) {
+			return false
+		}
+	}
+
+	for _, proxyAddr := range proxyAddrs {
+		if _, exists := m.names[proxyAddr.FullString()]; exists {
+			continue
+		}
+		if !m.register(proxyAddr) {
+			return false
+		}
+	}
+	return true
+}
+
+// 按心跳间隔发送心跳，会话关闭或者发送失败时返回
+func sendHeartbeat(control *controlConn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !control.sendMessage(Message{Type: messagePing}) {
+				closeWithoutError(control)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// 服务端是否支持代理映射需要的功能
+func supportsProxy(capabilities []string, proxyAddr config.NetAddress) bool {
+	for _, capability := range requiredCapabilities(proxyAddr.Type, proxyAddr.ProxyPort) {
+		if !hasCapability(capabilities, capability) {
+			return false
+		}
+	}
+	return true
+}
 
-		go buildServerTunnel(cfg, proxyAddr, &wg)
+// 按服务端请求打开工作连接，访问统计记录到 stats
+func (c *Client) openWorkConn(session *yamux.Session, cfg config.ClientConfig, port uint32, proxyAddr config.NetAddress, stats *tunnelStats) {
+	serverConn, err := session.Open()
+	if err != nil {
+		log.Println("打开工作连接失败！", err)
+		return
 	}
 
-	wg.Wait()
+	result, err := handshake(serverConn, cfg.Key, cfg.ClientID, port)
+	c.metrics.handshake(result.Result)
+	if err != nil {
+		log.Println("打开工作连接失败！", err)
+		closeWithoutError(serverConn)
+		return
+	}
+
+	// 服务端先发送访问者信息
+	var header []byte
+	if proxyAddr.ProxyProtocol != "" {
+		info, err := receiveVisitorInfo(serverConn)
+		if err != nil {
+			log.Println("接收访问者信息失败！", err)
+			closeWithoutError(serverConn)
+			return
+		}
+		header = proxyProtocolHeader(proxyAddr.ProxyProtocol, info)
+	}
+
+	// 接收到服务器端数据，准备数据传输
+	c.receiveData(proxyAddr, serverConn, header, stats)
+}
+
+// 本地服务连接拨号，先发送 header，并建立双向通道，访问统计记录到 stats，stats 为空时不记录
+func (c *Client) receiveData(proxyAddr config.NetAddress, serverConn net.Conn, header []byte, stats *tunnelStats) {
+	// 建立本地连接，进行连接数据传输
+	if localConn := dial(proxyAddr, 1, c.metrics); localConn != nil {
+		if len(header) > 0 {
+			if _, err := localConn.Write(header); err != nil {
+				log.Println("发送 PROXY protocol 头失败！", err)
+				closeWithoutError(localConn, serverConn)
+				return
+			}
+		}
+		if stats != nil {
+			defer stats.trackConn()()
+		}
+		in, out := newFlows(stats, nil)
+		if proxyAddr.Type == config.ProxyTypeUDP {
+			forwardUDP(serverConn, localConn, in, out)
+		} else {
+			forward(serverConn, localConn, in, out)
+		}
+	} else {
+		log.Printf("本地端口 [%d] 服务已停止！\n", proxyAddr.Port)
+		// 打开本地连接失败，关闭服务器流
+		closeWithoutError(serverConn)
+	}
 }
@@ -1,11 +1,15 @@
 package core
 
 import (
-	"fmt"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/aulang/netbus/config"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -25,22 +29,35 @@ func init() {
 }
 
 // 使用 bufferPool 重写 copy 函数， 避免反复 gc，提升性能
-func ioCopy(dst io.Writer, src io.Reader) (written int64, err error) {
-	if wt, ok := src.(io.WriterTo); ok {
-		return wt.WriteTo(dst)
-	}
-	if rt, ok := dst.(io.ReaderFrom); ok {
-		return rt.ReadFrom(src)
+// f 不为空时实时记录复制的字节数并按限速等待，此时不使用 WriterTo、ReaderFrom
+func ioCopy(dst io.Writer, src io.Reader, f *flow) (written int64, err error) {
+	if f == nil {
+		if wt, ok := src.(io.WriterTo); ok {
+			return wt.WriteTo(dst)
+		}
+		if rt, ok := dst.(io.ReaderFrom); ok {
+			return rt.ReadFrom(src)
+		}
 	}
 
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
+	size := len(buf)
+	if f != nil {
+		size = f.chunkSize(size)
+	}
 	for {
-		nr, er := src.Read(buf)
+		nr, er := src.Read(buf[:size])
 		if nr > 0 {
+			if f != nil {
+				f.wait(nr)
+			}
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
+				if f != nil {
+					f.add(nw)
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -62,6 +79,20 @@ func ioCopy(dst io.Writer, src io.Reader) (written int64, err error) {
 	return written, err
 }
 
+// 带缓冲读取的连接，预读数据之后继续使用
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
 // 关闭连接
 func closeWithoutError(closers ...io.Closer) {
 	for _, closer := range closers {
@@ -71,17 +102,31 @@ func closeWithoutError(closers ...io.Closer) {
 	}
 }
 
-// 拨号
-func dial(targetAddr config.NetAddress /*目标地址*/, maxRedialTimes int /*最大重拨次数*/) net.Conn {
+// 拨号，失败及重拨次数记录到 m，m 可以为空
+func dial(targetAddr config.NetAddress /*目标地址*/, maxRedialTimes int /*最大重拨次数*/, m *metrics) net.Conn {
+	return dialTLS(targetAddr, nil, 0, maxRedialTimes, m)
+}
+
+// TLS拨号，tlsConfig 为空时使用普通 TCP 连接，keepAlive 为0时使用系统默认的TCP keepalive 间隔
+func dialTLS(targetAddr config.NetAddress /*目标地址*/, tlsConfig *tls.Config, keepAlive time.Duration, maxRedialTimes int /*最大重拨次数*/, m *metrics) net.Conn {
+	dialer := &net.Dialer{KeepAlive: keepAlive}
 	redialTimes := 0
 	for {
-		conn, err := net.Dial("tcp", targetAddr.String())
+		var conn net.Conn
+		var err error
+		if tlsConfig == nil {
+			conn, err = dialer.Dial(targetAddr.Network(), targetAddr.String())
+		} else {
+			conn, err = tls.DialWithDialer(dialer, "tcp", targetAddr.String(), tlsConfig)
+		}
 		if err == nil {
 			return conn
 		}
 		redialTimes++
+		m.dialFailed(targetAddr.String())
 		if maxRedialTimes < 0 || redialTimes < maxRedialTimes {
 			// 重连模式，每5秒一次
+			m.dialRetried(targetAddr.String())
 			log.Printf("连接到 [%s] 失败, %d秒之后重连(%d)。\n", targetAddr.String(), retryIntervalTime, redialTimes)
 			time.Sleep(retryIntervalTime * time.Second)
 		} else {
@@ -91,17 +136,34 @@ func dial(targetAddr config.NetAddress /*目标地址*/, maxRedialTimes int /*
 	}
 }
 
+// 监听地址，host 为空时监听所有地址
+func listenAddress(host string, port uint32) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
 // TCP监听端口
-func listen(port uint32) (net.Listener, error) {
-	address := fmt.Sprintf("0.0.0.0:%d", port)
-	return net.Listen("tcp", address)
+func listen(host string, port uint32) (net.Listener, error) {
+	return net.Listen("tcp", listenAddress(host, port))
 }
 
-// 连接数据复制
-func netCopy(src io.ReadCloser, dst io.WriteCloser, wg *sync.WaitGroup) {
-	wg.Add(1)
+// UDP监听端口
+func listenUDP(host string, port uint32) (net.PacketConn, error) {
+	return net.ListenPacket("udp", listenAddress(host, port))
+}
+
+// TLS监听端口，tlsConfig 为空时使用普通 TCP 监听，keepAlive 为接受连接的TCP keepalive 间隔
+func listenTLS(host string, port uint32, tlsConfig *tls.Config, keepAlive time.Duration) (net.Listener, error) {
+	listenConfig := net.ListenConfig{KeepAlive: keepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", listenAddress(host, port))
+	if err != nil || tlsConfig == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
 
-	if _, err := ioCopy(dst, src); err != nil {
+// 连接数据复制
+func netCopy(src io.ReadCloser, dst io.WriteCloser, wg *sync.WaitGroup, f *flow) {
+	if _, err := ioCopy(dst, src, f); err != nil {
 		log.Println("连接中断！", err)
 	}
 
@@ -110,12 +172,46 @@ func netCopy(src io.ReadCloser, dst io.WriteCloser, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
-// 连接数据转发
-func forward(src io.ReadWriteCloser, dst io.ReadWriteCloser) {
+// 连接数据转发，src 为访问方，in、out 分别控制两个方向的转发，可以为空
+func forward(src io.ReadWriteCloser, dst io.ReadWriteCloser, in *flow, out *flow) {
 	var wg sync.WaitGroup
+	wg.Add(2)
 
-	go netCopy(src, dst, &wg)
-	go netCopy(dst, src, &wg)
+	go netCopy(src, dst, &wg, in)
+	go netCopy(dst, src, &wg, out)
 
 	wg.Wait()
 }
+
+// 获取客户端证书身份，未提供证书时返回空
+func peerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", nil
+	}
+	return certIdentity(chains[0][0]), nil
+}
+
+// 证书身份，优先使用 CommonName，其次使用 SAN
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
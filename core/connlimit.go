@@ -0,0 +1,129 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 访问连接数限制器，限制并发连接数及每秒新建连接数，可在使用中修改限制
+type connLimiter struct {
+	mutex   sync.Mutex
+	limit   config.ConnLimit
+	active  int64         // 已准入的连接数
+	release chan struct{} // 有连接结束时关闭，通知排队的访问者
+	rate    *rateLimiter  // 新建连接限速
+}
+
+func newConnLimiter(limit config.ConnLimit) *connLimiter {
+	return &connLimiter{
+		limit:   limit,
+		release: make(chan struct{}),
+		rate:    newRateLimiter(limit.RateLimit()),
+	}
+}
+
+// 修改限制，已准入的连接不受影响
+func (l *connLimiter) setLimit(limit config.ConnLimit) {
+	l.mutex.Lock()
+	l.limit = limit
+	l.mutex.Unlock()
+	l.rate.setLimit(limit.RateLimit())
+}
+
+// 排队等待的时间
+func (l *connLimiter) queueTimeout() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit.QueueTimeout
+}
+
+// 准入一个访问连接，超出限制时最多等待到 deadline，done 关闭时放弃，准入成功时需调用 done 释放
+func (l *connLimiter) acquire(deadline time.Time, done <-chan struct{}) bool {
+	// 新建连接限速
+	maxWait := time.Until(deadline)
+	if maxWait < 0 {
+		maxWait = 0
+	}
+	delay, ok := l.rate.reserve(1, maxWait)
+	if !ok {
+		return false
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			l.rate.refund(1)
+			return false
+		}
+	}
+
+	// 并发连接数，超出限制未能准入时归还新建连接的令牌，不占用之后访问者的速率
+	for {
+		l.mutex.Lock()
+		if l.limit.MaxConns <= 0 || l.active < l.limit.MaxConns {
+			l.active++
+			l.mutex.Unlock()
+			return true
+		}
+		release := l.release
+		l.mutex.Unlock()
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			l.rate.refund(1)
+			return false
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-release:
+			timer.Stop()
+		case <-timer.C:
+			l.rate.refund(1)
+			return false
+		case <-done:
+			timer.Stop()
+			l.rate.refund(1)
+			return false
+		}
+	}
+}
+
+// 释放一个已准入的连接，通知排队的访问者
+func (l *connLimiter) done() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.active--
+	close(l.release)
+	l.release = make(chan struct{})
+}
+
+// 准入访问连接，依次检查代理自身及客户端共享的连接数限制
+// 超出限制时按各自的排队时间等待，仍超出限制或者通道关闭时拒绝并计数，已准入的限制器归还令牌，准入成功时返回释放函数
+func (t *ClientTunnel) admit() (func(), bool) {
+	start := time.Now()
+	var acquired []*connLimiter
+	release := func() {
+		for _, limiter := range acquired {
+			limiter.done()
+		}
+	}
+
+	for _, limiter := range t.connLimiters {
+		if !limiter.acquire(start.Add(limiter.queueTimeout()), t.done) {
+			// 之前已准入的限制器同样归还新建连接的令牌
+			release()
+			for _, admitted := range acquired {
+				admitted.rate.refund(1)
+			}
+			atomic.AddInt64(&t.stats.rejectedConns, 1)
+			return nil, false
+		}
+		acquired = append(acquired, limiter)
+	}
+	return release, true
+}
@@ -0,0 +1,282 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"log"
+	"net"
+	"sync"
+)
+
+// 负载均衡组，多个客户端会话使用相同的组名注册同一个访问端口，共享访问端口监听
+// 每个成员都是一个使用虚拟端口的代理通道，与域名代理相同，访问连接按策略分配给成员
+// 成员的代理通道关闭时移出组，所有成员移出之后停止监听访问端口
+type tunnelGroup struct {
+	name     string       // 组名
+	balance  string       // 负载均衡策略
+	port     uint32       // 访问端口
+	bindAddr string       // 访问端口监听地址，为空时监听所有地址
+	owner    string       // 创建者的客户端标识，同 config.ClientLimitIdentity
+	ownerID  string       // 创建者的客户端编号，用于判断访问端口的归属
+	server   *Server      // 所属服务端
+	listener net.Listener // 访问端口监听
+	mutex    sync.Mutex
+	closed   bool
+	members  []*groupMember
+	next     int // 轮询及最少连接下一次开始查找的成员
+}
+
+// 负载均衡组成员
+type groupMember struct {
+	tunnel  *ClientTunnel
+	weight  int64 // 权重
+	current int64 // 平滑加权轮询的当前权重
+	conns   int64 // 分配给该成员进行中的访问连接数，包括等待客户端连接的
+}
+
+// 加入负载均衡组，需持有 tunnelMutex，访问端口已被其他代理或者其他组占用时返回失败
+// 返回结果及成员通道的虚拟端口，客户端按虚拟端口建立工作连接
+func (s *Server) joinGroup(protocol Protocol, message Message, group config.ProxyGroup, session *clientSession, bindAddr string) (byte, uint32) {
+	port := message.Port
+	owner := config.ClientLimitIdentity(session.identity, session.key)
+	if _, exists := s.tunnels.Load(port); exists {
+		log.Printf("访问端口已被占用：[%d]，客户端：[%s]\n", port, session.String())
+		return protocolResultPortInUse, port
+	}
+
+	protocol.Port = s.nextVirtualPort()
+	clientTunnel := s.newTunnel(protocol, config.ProxyTypeTCP, session.identity, session, "")
+	clientTunnel.setMapping(message)
+	member := &groupMember{tunnel: clientTunnel, weight: group.Weight}
+
+	for {
+		var portGroup *tunnelGroup
+		if value, exists := s.groups.Load(port); exists {
+			portGroup = value.(*tunnelGroup)
+		} else {
+			listener, err := listen(bindAddr, port)
+			if err != nil {
+				log.Printf("监听代理端口失败：[tcp/%d]，端口已被占用：[%s]\n", port, err.Error())
+				return protocolResultPortInUse, port
+			}
+			portGroup = &tunnelGroup{
+				name:     group.Name,
+				balance:  group.Balance,
+				port:     port,
+				bindAddr: bindAddr,
+				owner:    owner,
+				ownerID:  session.ownerID(),
+				server:   s,
+				listener: listener,
+			}
+			s.groups.Store(port, portGroup)
+			go portGroup.serve()
+		}
+
+		// 组名相同且与创建者为同一客户端才能加入，避免访问连接被分配给无关的客户端
+		switch {
+		case portGroup.name != group.Name:
+			log.Printf("访问端口已被其他负载均衡组占用：[%d]，组：[%s]，客户端：[%s]\n", port, portGroup.name, session.String())
+			return protocolResultPortInUse, port
+		case !portGroup.allowJoin(s.config(), owner, session.ownerID()):
+			log.Printf("负载均衡组归其他客户端所有：[%s/%d]，客户端：[%s]\n", portGroup.name, port, session.String())
+			return protocolResultPortInUse, port
+		case portGroup.balance != group.Balance:
+			log.Printf("负载均衡策略与组内不一致：[%s]，组：[%s/%s]，客户端：[%s]\n", group.Balance, portGroup.name, portGroup.balance, session.String())
+			return protocolResultFail, port
+		case portGroup.bindAddr != bindAddr:
+			log.Printf("监听地址与组内不一致：[%s]，组：[%s]，客户端：[%s]\n", bindAddr, portGroup.name, session.String())
+			return protocolResultFail, port
+		}
+
+		clientTunnel.group = portGroup
+		if portGroup.add(member) {
+			break
+		}
+		// 最后一个成员刚刚移出，组已关闭，重新创建
+	}
+
+	// 先保存再加入会话，会话同时关闭时由通道关闭移除，避免残留已关闭的成员
+	s.tunnels.Store(protocol.Port, clientTunnel)
+	if !session.addTunnel(clientTunnel) {
+		clientTunnel.close()
+		return protocolResultFail, port
+	}
+	log.Printf("已加入负载均衡组：[%s/%d]，策略：[%s]，权重：[%d]，客户端：[%s]\n", group.Name, port, group.Balance, group.Weight, session.String())
+
+	return protocolResultSuccess, protocol.Port
+}
+
+// 客户端是否可以加入，须与创建者为同一客户端，或者双方的客户端凭据都配置了该访问端口
+// 已加入的成员都满足该条件，因此所有成员的凭据都配置了该端口，或者与创建者为同一客户端
+func (g *tunnelGroup) allowJoin(cfg config.ServerConfig, owner string, ownerID string) bool {
+	if owner == g.owner || (ownerID != "" && ownerID == g.ownerID) {
+		return true
+	}
+	return cfg.CredentialOwnsPort(g.port, g.ownerID) && cfg.CredentialOwnsPort(g.port, ownerID)
+}
+
+// 添加成员，组已关闭时返回 false
+func (g *tunnelGroup) add(member *groupMember) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.members = append(g.members, member)
+	return true
+}
+
+// 移出成员通道，所有成员移出之后关闭组并停止监听访问端口
+func (g *tunnelGroup) remove(tunnel *ClientTunnel) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for i, member := range g.members {
+		if member.tunnel == tunnel {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			log.Printf("已移出负载均衡组：[%s/%d]，剩余成员：[%d]\n", g.name, g.port, len(g.members))
+			break
+		}
+	}
+	if len(g.members) > 0 || g.closed {
+		return
+	}
+	// 在锁内移除，加入时发现组已关闭即可重新创建
+	g.closed = true
+	g.server.groups.Delete(g.port)
+	closeWithoutError(g.listener)
+	log.Printf("已关闭负载均衡组：[%s/%d]\n", g.name, g.port)
+}
+
+// 按负载均衡策略选择一个成员，跳过 tried 中已尝试过的成员，没有可用成员时返回空
+// 选中的成员计入进行中的访问连接，结束时调用 release
+func (g *tunnelGroup) pick(tried []*groupMember) *groupMember {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var picked *groupMember
+	count := len(g.members)
+	switch g.balance {
+	case config.BalanceWeighted:
+		// 平滑加权轮询，权重高的成员分配更多，且不会连续集中分配
+		var total int64
+		for _, member := range g.members {
+			if containsMember(tried, member) {
+				continue
+			}
+			member.current += member.weight
+			total += member.weight
+			if picked == nil || member.current > picked.current {
+				picked = member
+			}
+		}
+		if picked != nil {
+			picked.current -= total
+		}
+	case config.BalanceLeastConn:
+		// 连接数相同时从上次之后开始，避免总是分配给第一个成员
+		for i := 0; i < count; i++ {
+			member := g.members[(g.next+i)%count]
+			if !containsMember(tried, member) && (picked == nil || member.conns < picked.conns) {
+				picked = member
+			}
+		}
+		if count > 0 {
+			g.next = (g.next + 1) % count
+		}
+	default:
+		for i := 0; i < count; i++ {
+			member := g.members[(g.next+i)%count]
+			if !containsMember(tried, member) {
+				picked = member
+				g.next = (g.next + i + 1) % count
+				break
+			}
+		}
+	}
+
+	if picked != nil {
+		picked.conns++
+	}
+	return picked
+}
+
+// 成员的访问连接结束
+func (g *tunnelGroup) release(member *groupMember) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	member.conns--
+}
+
+// 成员信息，不是该组的成员时返回空
+func (g *tunnelGroup) member(tunnel *ClientTunnel) *groupMember {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, member := range g.members {
+		if member.tunnel == tunnel {
+			copied := *member
+			return &copied
+		}
+	}
+	return nil
+}
+
+// 是否已尝试过该成员
+func containsMember(members []*groupMember, member *groupMember) bool {
+	for _, m := range members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// 受理访问端口的连接
+func (g *tunnelGroup) serve() {
+	log.Printf("正在监听负载均衡组代理端口：[%d]，组：[%s]，策略：[%s]\n", g.port, g.name, g.balance)
+
+	for {
+		proxyConn, err := g.listener.Accept()
+		if err != nil {
+			g.mutex.Lock()
+			closed := g.closed
+			g.mutex.Unlock()
+			if closed || g.server.draining() {
+				return
+			}
+			log.Println("接受代理端口连接失败！", err)
+			continue
+		}
+		if !g.server.allowVisitor(g.port, proxyConn.RemoteAddr()) {
+			closeWithoutError(proxyConn)
+			continue
+		}
+
+		go g.handleVisitorConn(proxyConn)
+	}
+}
+
+// 处理访问连接，按策略选择成员转发，成员未能提供客户端连接时换下一个成员
+// 客户端断开但会话尚未超时的成员因此不会导致访问失败
+func (g *tunnelGroup) handleVisitorConn(proxyConn net.Conn) {
+	defer g.server.trackConn()()
+
+	var tried []*groupMember
+	for {
+		member := g.pick(tried)
+		if member == nil {
+			log.Printf("负载均衡组没有可用的客户端：[%s/%d]\n", g.name, g.port)
+			closeWithoutError(proxyConn)
+			return
+		}
+		tried = append(tried, member)
+
+		served := member.tunnel.allow(proxyConn.RemoteAddr()) && member.tunnel.serveVisitor(proxyConn)
+		g.release(member)
+		if served {
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// 访问地址的IP，无法解析时返回空
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// 服务端配置是否允许访问地址访问代理端口，拒绝时记录日志
+func (s *Server) allowVisitor(port uint32, addr net.Addr) bool {
+	cfg := s.config()
+	if cfg.IPAllowed(port, addrIP(addr)) {
+		return true
+	}
+	log.Printf("拒绝访问地址：[%s]，代理端口：[%d]\n", addr, port)
+	return false
+}
+
+// 通道是否允许访问地址访问，拒绝时记录日志
+// 端口代理同时检查服务端对该端口的过滤，域名代理及负载均衡组在共享端口受理连接时已检查
+func (t *ClientTunnel) allow(addr net.Addr) bool {
+	if len(t.domains) == 0 && t.group == nil && !t.server.allowVisitor(t.protocol.Port, addr) {
+		atomic.AddInt64(&t.stats.deniedConns, 1)
+		return false
+	}
+	if t.ipFilter.Allowed(addrIP(addr)) {
+		return true
+	}
+	atomic.AddInt64(&t.stats.deniedConns, 1)
+	if len(t.domains) > 0 {
+		log.Printf("拒绝访问地址：[%s]，访问域名：%v\n", addr, t.domains)
+	} else {
+		log.Printf("拒绝访问地址：[%s]，代理端口：[%d]\n", addr, t.proxyPort())
+	}
+	return false
+}
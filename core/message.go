@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/aulang/netbus/config"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 控制消息类型
+	messageRegister       = 1 // 客户端注册代理端口
+	messageRegisterResult = 2 // 服务端返回注册结果
+	messageNewConn        = 3 // 服务端请求客户端建立工作连接
+	messagePing           = 4 // 客户端发送心跳
+	messagePong           = 5 // 服务端响应心跳
+	messageShutdown       = 6 // 服务端通知客户端即将停止
+	messageUnregister     = 7 // 客户端取消注册代理
+
+	// 控制消息最大长度
+	maxMessageLength = 64 * 1024
+)
+
+// 控制消息格式，与协议格式相同
+// 消息长度(4字节)|JSON消息体
+
+// 控制消息
+type Message struct {
+	Type      byte     `json:"type"`                 // 消息类型
+	Result    byte     `json:"result,omitempty"`     // 结果，同协议结果
+	Name      string   `json:"name,omitempty"`       // 代理映射名称，用于对应注册结果
+	Port      uint32   `json:"port,omitempty"`       // 访问端口，注册结果中域名代理及负载均衡组成员为服务端分配的虚拟端口
+	ProxyType string   `json:"proxy_type,omitempty"` // 代理类型，默认 tcp
+	Domains   []string `json:"domains,omitempty"`    // 访问域名，仅域名代理使用
+	Rate      int64    `json:"rate,omitempty"`       // 代理限速，每秒字节数
+	Burst     int64    `json:"burst,omitempty"`      // 代理限速允许的突发字节数
+
+	MaxConns     int64 `json:"max_conns,omitempty"`     // 最大并发连接数
+	ConnRate     int64 `json:"conn_rate,omitempty"`     // 每秒新建连接数
+	ConnBurst    int64 `json:"conn_burst,omitempty"`    // 新建连接允许的突发数
+	QueueTimeout int64 `json:"queue_timeout,omitempty"` // 超出限制时排队等待的毫秒数
+
+	Allow []string `json:"allow,omitempty"` // 允许访问的地址段
+	Deny  []string `json:"deny,omitempty"`  // 拒绝访问的地址段
+
+	ProxyProtocol string `json:"proxy_protocol,omitempty"` // 客户端向本地服务发送的 PROXY protocol 版本
+	BindAddr      string `json:"bind_addr,omitempty"`      // 服务端监听访问端口的地址
+
+	Group   string `json:"group,omitempty"`   // 负载均衡组名
+	Balance string `json:"balance,omitempty"` // 负载均衡策略
+	Weight  int64  `json:"weight,omitempty"`  // 负载均衡权重
+}
+
+// 代理的连接数限制
+func (m *Message) connLimit() config.ConnLimit {
+	return config.ConnLimit{
+		MaxConns:     m.MaxConns,
+		Rate:         m.ConnRate,
+		Burst:        m.ConnBurst,
+		QueueTimeout: time.Duration(m.QueueTimeout) * time.Millisecond,
+	}
+}
+
+// 设置代理的连接数限制
+func (m *Message) setConnLimit(limit config.ConnLimit) {
+	m.MaxConns, m.ConnRate, m.ConnBurst = limit.MaxConns, limit.Rate, limit.Burst
+	m.QueueTimeout = int64(limit.QueueTimeout / time.Millisecond)
+}
+
+// 代理的负载均衡组，格式不对时返回错误
+func (m *Message) proxyGroup() (config.ProxyGroup, error) {
+	var weight string
+	if m.Weight != 0 {
+		weight = strconv.FormatInt(m.Weight, 10)
+	}
+	return config.ParseProxyGroup(m.Group, m.Balance, weight)
+}
+
+// 设置代理的负载均衡组
+func (m *Message) setProxyGroup(group config.ProxyGroup) {
+	m.Group, m.Balance, m.Weight = group.Name, group.Balance, group.Weight
+}
+
+// 控制连接，发送消息时加锁，避免多个协程同时写入
+type controlConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	timeout time.Duration // 心跳超时时间，超过该时间未收到消息则断开，为0时不超时
+}
+
+func newControlConn(conn net.Conn) *controlConn {
+	return &controlConn{Conn: conn}
+}
+
+// 发送控制消息
+func (c *controlConn) sendMessage(message Message) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := writeFrame(c, message); err != nil {
+		log.Println("发送控制消息失败！", err)
+		return false
+	}
+	return true
+}
+
+// 接收控制消息，连接断开时返回 false
+func (c *controlConn) receiveMessage() (Message, bool) {
+	var message Message
+
+	if c.timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+
+	var length uint32
+	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Printf("心跳超时：[%s]，%s内未收到对端消息\n", c.RemoteAddr().String(), c.timeout)
+		}
+		return message, false
+	}
+	if err := readFrameBody(c, length, &message); err != nil {
+		log.Println("解析控制消息失败！", err)
+		return message, false
+	}
+	return message, true
+}
+
+// 写入一帧JSON数据
+func writeFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	_ = binary.Write(buffer, binary.BigEndian, uint32(len(body)))
+	buffer.Write(body)
+
+	_, err = w.Write(buffer.Bytes())
+	return err
+}
+
+// 读取已知长度的JSON数据
+func readFrameBody(r io.Reader, length uint32, v interface{}) error {
+	if length > maxMessageLength {
+		return fmt.Errorf("数据长度超出限制：%d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/aulang/netbus/config"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 监控指标，按 Prometheus 文本格式输出
+type metrics struct {
+	mutex sync.Mutex
+
+	// key:   握手结果
+	// value: 次数
+	handshakes map[byte]int64
+
+	// key:   目标地址
+	// value: 次数
+	dialFailures map[string]int64
+	dialRetries  map[string]int64
+
+	// key:   服务端访问端口，负载均衡组成员及域名代理为虚拟端口
+	// value: 客户端各代理的访问统计，服务端使用通道自身的统计
+	ports map[uint32]*portMetrics
+}
+
+// 客户端单个代理的统计，按访问端口或者访问域名输出
+type portMetrics struct {
+	entry portStatsEntry
+	stats tunnelStats
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		handshakes:   make(map[byte]int64),
+		dialFailures: make(map[string]int64),
+		dialRetries:  make(map[string]int64),
+		ports:        make(map[uint32]*portMetrics),
+	}
+}
+
+// 记录握手结果，m 为空时忽略
+func (m *metrics) handshake(result byte) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handshakes[result]++
+}
+
+// 记录拨号失败，m 为空时忽略
+func (m *metrics) dialFailed(target string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dialFailures[target]++
+}
+
+// 记录拨号重试，m 为空时忽略
+func (m *metrics) dialRetried(target string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dialRetries[target]++
+}
+
+// 代理的统计，不存在时创建，m 为空时返回空
+// port 为服务端访问端口，负载均衡组成员按组的访问端口输出，域名代理按访问域名输出，与服务端一致
+func (m *metrics) portStats(port uint32, proxyAddr config.NetAddress) *tunnelStats {
+	if m == nil {
+		return nil
+	}
+	entry := portStatsEntry{port: port, proxyType: proxyAddr.Type}
+	if entry.proxyType == "" {
+		entry.proxyType = config.ProxyTypeTCP
+	}
+	switch {
+	case len(proxyAddr.Domains) > 0:
+		entry.port, entry.domains = 0, strings.Join(proxyAddr.Domains, ",")
+	case proxyAddr.Group.Enabled():
+		entry.port = proxyAddr.ProxyPort
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pm, exists := m.ports[port]
+	if !exists {
+		pm = &portMetrics{entry: entry}
+		m.ports[port] = pm
+	}
+	return &pm.stats
+}
+
+// 移除访问端口的统计，代理取消注册或者会话断开时调用，进行中的连接继续记录到已移除的统计
+func (m *metrics) removePort(port uint32) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.ports, port)
+}
+
+// 输出握手及拨号指标，在锁内复制之后再输出，避免缓慢的请求阻塞连接的统计
+func (m *metrics) write(w *metricsWriter) {
+	m.mutex.Lock()
+	handshakes := make(map[byte]int64, len(m.handshakes))
+	for result, count := range m.handshakes {
+		handshakes[result] = count
+	}
+	dialFailures, dialRetries := copyCounts(m.dialFailures), copyCounts(m.dialRetries)
+	m.mutex.Unlock()
+
+	w.header("netbus_handshakes_total", "counter", "握手次数，按结果分类")
+	results := make([]int, 0, len(handshakes))
+	for result := range handshakes {
+		results = append(results, int(result))
+	}
+	sort.Ints(results)
+	for _, result := range results {
+		w.sample("netbus_handshakes_total", handshakes[byte(result)], "result", protocolResultName(byte(result)))
+	}
+
+	for _, item := range []struct {
+		name   string
+		help   string
+		values map[string]int64
+	}{
+		{"netbus_dial_failures_total", "拨号失败次数，按目标地址分类", dialFailures},
+		{"netbus_dial_retries_total", "拨号重试次数，按目标地址分类", dialRetries},
+	} {
+		if len(item.values) == 0 {
+			continue
+		}
+		w.header(item.name, "counter", item.help)
+		targets := make([]string, 0, len(item.values))
+		for target := range item.values {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			w.sample(item.name, item.values[target], "target", target)
+		}
+	}
+}
+
+// 复制按目标地址分类的次数
+func copyCounts(counts map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(counts))
+	for target, count := range counts {
+		copied[target] = count
+	}
+	return copied
+}
+
+// 输出客户端各访问端口的指标，同一负载均衡组或者相同访问域名的多个代理合计
+func (m *metrics) writePorts(w *metricsWriter) {
+	m.mutex.Lock()
+	totals := make(map[portStatsEntry]*tunnelStats, len(m.ports))
+	for _, pm := range m.ports {
+		total, exists := totals[pm.entry]
+		if !exists {
+			total = &tunnelStats{}
+			totals[pm.entry] = total
+		}
+		total.add(&pm.stats)
+	}
+	m.mutex.Unlock()
+
+	ports := make([]portStatsEntry, 0, len(totals))
+	for entry, total := range totals {
+		entry.stats = total
+		ports = append(ports, entry)
+	}
+	writePortStats(w, ports, false)
+}
+
+// 单个访问端口的统计，用于输出
+type portStatsEntry struct {
+	port      uint32
+	domains   string // 客户端的域名代理按访问域名输出，不输出访问端口
+	proxyType string
+	stats     *tunnelStats
+}
+
+// 指标标签
+func (e portStatsEntry) labels() []string {
+	if e.domains != "" {
+		return []string{"domain", e.domains, "type", e.proxyType}
+	}
+	return []string{"port", strconv.Itoa(int(e.port)), "type", e.proxyType}
+}
+
+// 访问端口统计对应的指标
+type portStatsMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s *tunnelStats) int64
+}
+
+// 输出各访问端口的连接数及字节数，server 为 true 时输出服务端才有的等待、拒绝连接数
+func writePortStats(w *metricsWriter, ports []portStatsEntry, server bool) {
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].port != ports[j].port {
+			return ports[i].port < ports[j].port
+		}
+		if ports[i].domains != ports[j].domains {
+			return ports[i].domains < ports[j].domains
+		}
+		return ports[i].proxyType < ports[j].proxyType
+	})
+
+	items := []portStatsMetric{
+		{"netbus_tunnel_active_connections", "gauge", "进行中的访问连接数",
+			func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.activeConns) }},
+		{"netbus_tunnel_bytes_in_total", "counter", "访问者发送给内网服务的字节数",
+			func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.bytesIn) }},
+		{"netbus_tunnel_bytes_out_total", "counter", "内网服务返回给访问者的字节数",
+			func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.bytesOut) }},
+	}
+	if server {
+		items = append(items, portStatsMetric{"netbus_tunnel_idle_connections", "gauge", "等待访问的客户端连接数",
+			func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.idleConns) }},
+			portStatsMetric{"netbus_tunnel_rejected_connections_total", "counter", "超出连接数限制被拒绝的访问连接数",
+				func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.rejectedConns) }},
+			portStatsMetric{"netbus_tunnel_denied_connections_total", "counter", "访问地址不允许被拒绝的访问连接数",
+				func(s *tunnelStats) int64 { return atomic.LoadInt64(&s.deniedConns) }})
+	}
+
+	for _, item := range items {
+		w.header(item.name, item.kind, item.help)
+		for _, entry := range ports {
+			w.sample(item.name, item.value(entry.stats), entry.labels()...)
+		}
+	}
+}
+
+// 输出服务端监控指标
+func (s *Server) writeMetrics(w *metricsWriter) {
+	s.metrics.write(w)
+
+	var sessions int64
+	s.sessions.Range(func(key, value interface{}) bool {
+		sessions++
+		return true
+	})
+	w.header("netbus_sessions", "gauge", "已连接的客户端会话数，不含旧版客户端")
+	w.sample("netbus_sessions", sessions)
+
+	w.header("netbus_active_connections", "gauge", "进行中的访问连接数")
+	w.sample("netbus_active_connections", s.ActiveConns())
+
+	// 负载均衡组成员及域名代理按共享的访问端口合计
+	var ports []portStatsEntry
+	totals := make(map[portStatsEntry]*tunnelStats)
+	s.tunnels.Range(func(key, value interface{}) bool {
+		tunnel := value.(*ClientTunnel)
+		entry := portStatsEntry{port: tunnel.proxyPort(), proxyType: tunnel.proxyType}
+		if !tunnel.virtual() {
+			entry.stats = &tunnel.stats
+			ports = append(ports, entry)
+			return true
+		}
+		total, exists := totals[entry]
+		if !exists {
+			total = &tunnelStats{}
+			totals[entry] = total
+		}
+		total.add(&tunnel.stats)
+		return true
+	})
+	for entry, total := range totals {
+		entry.stats = total
+		ports = append(ports, entry)
+	}
+	writePortStats(w, ports, true)
+}
+
+// 输出客户端监控指标
+func (c *Client) writeMetrics(w *metricsWriter) {
+	c.metrics.write(w)
+	c.metrics.writePorts(w)
+}
+
+// 握手结果名称，用于指标标签
+func protocolResultName(result byte) string {
+	switch result {
+	case protocolResultSuccess:
+		return "success"
+	case protocolResultFailToReceive:
+		return "fail_to_receive"
+	case protocolResultFailToAuth:
+		return "fail_to_auth"
+	case protocolResultVersionMismatch:
+		return "version_mismatch"
+	case protocolResultIllegalAccessPort:
+		return "illegal_access_port"
+	case protocolResultPortInUse:
+		return "port_in_use"
+	case protocolResultDomainInUse:
+		return "domain_in_use"
+	case protocolResultChallenge:
+		return "challenge"
+	default:
+		return "fail"
+	}
+}
+
+// Prometheus 文本格式输出
+type metricsWriter struct {
+	w io.Writer
+}
+
+// 输出指标说明及类型
+func (w *metricsWriter) header(name string, kind string, help string) {
+	_, _ = fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// 输出一个样本，labels 为标签名与标签值交替排列
+func (w *metricsWriter) sample(name string, value int64, labels ...string) {
+	_, _ = io.WriteString(w.w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		separator := ","
+		if i == 0 {
+			separator = "{"
+		}
+		_, _ = fmt.Fprintf(w.w, "%s%s=%q", separator, labels[i], labels[i+1])
+	}
+	if len(labels) > 0 {
+		_, _ = io.WriteString(w.w, "}")
+	}
+	_, _ = fmt.Fprintf(w.w, " %d\n", value)
+}
+
+// 监听监控指标端口，请求 /metrics 时调用 write 输出指标
+// token 返回访问令牌，为空时不校验，只有监听本机地址时才能不配置令牌
+func listenMetrics(addr string, token func() string, write func(w *metricsWriter)) (*http.Server, net.Listener, error) {
+	if token() == "" && !loopbackAddr(addr) {
+		return nil, nil, errors.New("监控指标端口监听非本机地址时须配置访问令牌")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		if expected := token(); expected != "" {
+			provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+				http.Error(rw, "访问令牌错误", http.StatusUnauthorized)
+				return
+			}
+		}
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		write(&metricsWriter{w: rw})
+	})
+	return &http.Server{Handler: mux}, listener, nil
+}
+
+// 受理监控指标请求
+func serveMetrics(server *http.Server, listener net.Listener) {
+	log.Printf("正在监听监控指标端口：[%s]\n", listener.Addr())
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println("监控指标端口已停止！", err)
+	}
+}
@@ -0,0 +1,21 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"github.com/hashicorp/yamux"
+	"log"
+)
+
+// 多路复用协议版本号，也是会话的第一个字节
+// 旧版协议第一个字节为协议长度，不会为0，以此区分
+const muxProtocolVersion = 0
+
+// 多路复用配置，每个数据流独立流量控制
+// 会话层按心跳间隔发送 keepalive，对端超时未响应时关闭会话
+func muxConfig(heartbeat config.HeartbeatConfig) *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = log.Writer()
+	cfg.KeepAliveInterval = heartbeat.Interval
+	cfg.ConnectionWriteTimeout = heartbeat.Timeout
+	return cfg
+}
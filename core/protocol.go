@@ -3,7 +3,10 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/aulang/netbus/config"
+	"io"
 	"log"
 	"net"
 )
@@ -16,38 +19,138 @@ const (
 	protocolResultFailToAuth        = 3 // 鉴权失败
 	protocolResultVersionMismatch   = 4 // 版本不匹配
 	protocolResultIllegalAccessPort = 5 // 访问端口不合法
+	protocolResultPortInUse         = 6 // 访问端口已被占用
+	protocolResultDomainInUse       = 7 // 访问域名已被占用
+	protocolResultChallenge         = 8 // 认证挑战，客户端需发送证明
 
-	// 版本号(单调递增)
-	protocolVersion = 1
+	// 版本号(单调递增)，版本3开始使用可扩展的新版协议格式，之后的新功能通过功能协商启用
+	// 版本4开始使用挑战应答认证，握手时不再发送密钥，认证发生在功能协商之前，因此升级版本号
+	protocolVersion = 4
+	// 新版协议格式的最低版本号，握手时发送密钥
+	protocolVersionFrame = 3
+	// 旧版本号，客户端预先建立连接池，不使用控制连接
+	protocolVersionLegacy = 1
+
+	// 功能，控制连接握手时协商，未协商的功能不可使用
+	capabilityUDP        = "udp"        // UDP代理
+	capabilityHTTP       = "http"       // HTTP域名代理
+	capabilityHTTPS      = "https"      // HTTPS域名代理
+	capabilityAutoPort   = "auto_port"  // 服务端分配访问端口
+	capabilityHeartbeat  = "heartbeat"  // 控制连接心跳
+	capabilityShutdown   = "shutdown"   // 服务端停止通知
+	capabilityUnregister = "unregister" // 客户端取消注册代理，用于重新加载配置
+	capabilityRateLimit  = "rate_limit" // 按代理限速
+	capabilityConnLimit  = "conn_limit" // 按代理限制连接数
+	capabilityIPFilter   = "ip_filter"  // 按代理过滤访问地址
+	// 工作连接发送访问者地址，由客户端向本地服务发送 PROXY protocol 头
+	capabilityProxyProtocol = "proxy_protocol"
+	// 客户端指定服务端监听访问端口的地址
+	capabilityBindAddr = "bind_addr"
+	// 多个客户端通过负载均衡组共享访问端口
+	capabilityGroup = "group"
+)
+
+var (
+	// 服务端不支持客户端的协议版本
+	ErrVersionMismatch = errors.New("版本不匹配")
+	// 服务端认证失败
+	ErrAuthFailed = errors.New("认证失败")
 )
 
-// 协议格式
-// 结果|版本号|访问端口|Key
-// 1|2|17001|Aulang
+// 客户端支持的功能
+var clientCapabilities = []string{capabilityUDP, capabilityHTTP, capabilityHTTPS, capabilityAutoPort, capabilityHeartbeat, capabilityShutdown, capabilityUnregister, capabilityRateLimit, capabilityConnLimit, capabilityIPFilter, capabilityProxyProtocol, capabilityBindAddr, capabilityGroup}
+
+// 结果说明
+func protocolResultText(result byte) string {
+	switch result {
+	case protocolResultSuccess:
+		return "成功"
+	case protocolResultFailToReceive:
+		return "接收失败"
+	case protocolResultFailToAuth:
+		return "鉴权失败"
+	case protocolResultVersionMismatch:
+		return "版本不匹配"
+	case protocolResultIllegalAccessPort:
+		return "访问端口不合法"
+	case protocolResultPortInUse:
+		return "访问端口已被占用"
+	case protocolResultDomainInUse:
+		return "访问域名已被占用"
+	case protocolResultChallenge:
+		return "认证挑战"
+	default:
+		return "失败"
+	}
+}
+
+// 新版协议格式，与控制消息相同
+// 协议长度(4字节)|JSON协议体
+// {"result":1,"version":3,"port":17001,"key":"Aulang","capabilities":["udp"]}
+// 访问端口为0时表示控制连接，否则为对应访问端口的工作连接
+// 版本4不发送密钥，服务端先返回认证挑战，客户端再发送带证明的请求，见 auth.go
+//
+// 旧版协议格式，仅用于兼容版本1的客户端
+// 协议长度(1字节)|结果|版本号|访问端口|Key
+// 新版协议长度不超过 maxMessageLength，第一个字节总为0，以此区分
 
 // 协议
 type Protocol struct {
-	Result  byte   // 结果：0 失败，1 成功
-	Version uint32 // 版本号，单调递增
-	Port    uint32 // 访问端口
-	Key     string // 身份验证
+	Result       byte     `json:"result"`                 // 结果：0 失败，1 成功
+	Version      uint32   `json:"version"`                // 版本号，单调递增
+	Port         uint32   `json:"port,omitempty"`         // 访问端口
+	Key          string   `json:"key,omitempty"`          // 身份验证
+	Capabilities []string `json:"capabilities,omitempty"` // 请求时为客户端支持的功能，响应时为双方协商后的功能
+	Message      string   `json:"message,omitempty"`      // 失败原因
+	Token        string   `json:"token,omitempty"`        // 挑战应答认证时密钥的公开部分，超级密钥为空
+	Nonce        string   `json:"nonce,omitempty"`        // 认证挑战的随机数
+	Timestamp    int64    `json:"timestamp,omitempty"`    // 认证挑战的签发时间，Unix 秒数
+	Proof        string   `json:"proof,omitempty"`        // 客户端对认证挑战的证明
+	legacy       bool     // 是否为旧版定长格式，响应时使用相同格式
+	proven       bool     // 是否已通过挑战应答认证，Key 为服务端确认的密钥公开部分
 }
 
 // 转字符串
 func (p *Protocol) String() string {
-	return fmt.Sprintf("%d|%d|%d|%s", p.Result, p.Version, p.Port, p.Key)
+	key := p.Key
+	if key == "" {
+		key = p.Token
+	}
+	return fmt.Sprintf("%d|%d|%d|%s", p.Result, p.Version, p.Port, key)
 }
 
-// 返回一个新结果
+// 返回一个新结果，使用与请求相同的协议格式
 func (p *Protocol) NewResult(newResult byte) Protocol {
-	return Protocol{
+	result := Protocol{
 		Result:  newResult,
-		Version: p.Version,
+		Version: protocolVersion,
 		Port:    p.Port,
-		Key:     p.Key,
+		legacy:  p.legacy,
 	}
+	// 旧版客户端原样返回版本号及密钥
+	if p.legacy {
+		result.Version = p.Version
+		result.Key = p.Key
+	}
+	return result
+}
+
+// 返回一个失败结果，附带失败原因
+func (p *Protocol) NewError(newResult byte, format string, args ...interface{}) Protocol {
+	result := p.NewResult(newResult)
+	result.Message = fmt.Sprintf(format, args...)
+	return result
+}
+
+// 失败原因，未说明时使用结果说明
+func (p *Protocol) Reason() string {
+	if p.Message != "" {
+		return p.Message
+	}
+	return protocolResultText(p.Result)
 }
 
+// 旧版协议内容
 func (p *Protocol) Bytes() []byte {
 	buffer := bytes.NewBuffer([]byte{})
 
@@ -64,54 +167,103 @@ func (p *Protocol) Success() bool {
 	return p.Result == protocolResultSuccess
 }
 
-// 解析协议
+// 解析旧版协议
 func parseProtocol(body []byte) Protocol {
 	// 检查 body 长度，是否合法
 	if len(body) < 10 {
-		return Protocol{Result: protocolResultFail}
+		return Protocol{Result: protocolResultFail, legacy: true}
 	}
 	return Protocol{
 		Result:  body[0],
 		Version: binary.BigEndian.Uint32(body[1:5]),
 		Port:    binary.BigEndian.Uint32(body[5:9]),
 		Key:     string(body[9:]),
+		legacy:  true,
 	}
 }
 
 // 发送协议
-// 第一个字节为协议长度
-// 协议长度只支持到255
 func sendProtocol(conn net.Conn, protocol Protocol) bool {
-	pbs := protocol.Bytes()
-
-	buffer := bytes.NewBuffer([]byte{})
-	// 数据长度
-	buffer.WriteByte(byte(len(pbs)))
-	buffer.Write(pbs)
+	var err error
+	if protocol.legacy {
+		// 旧版协议长度只支持到255
+		pbs := protocol.Bytes()
+		_, err = conn.Write(append([]byte{byte(len(pbs))}, pbs...))
+	} else {
+		err = writeFrame(conn, protocol)
+	}
 
-	// 发送协议数据
-	if _, err := conn.Write(buffer.Bytes()); err != nil {
+	if err != nil {
 		log.Println("发送协议数据失败！", err)
 		return false
 	}
-
 	return true
 }
 
-// 接收协议
-// 第一个字节为协议长度
+// 接收协议，根据第一个字节区分新旧格式
 func receiveProtocol(conn net.Conn) Protocol {
-	var length byte
-	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:1]); err != nil {
 		log.Println("接受协议数据失败！", err)
 		return Protocol{Result: protocolResultFailToReceive}
 	}
-	// 读取协议内容
-	body := make([]byte, length)
-	if err := binary.Read(conn, binary.BigEndian, &body); err != nil {
+
+	// 旧版协议，第一个字节为协议长度
+	if head[0] != 0 {
+		body := make([]byte, head[0])
+		if _, err := io.ReadFull(conn, body); err != nil {
+			log.Println("接受协议数据失败！", err)
+			return Protocol{Result: protocolResultFailToReceive, legacy: true}
+		}
+		return parseProtocol(body)
+	}
+
+	var protocol Protocol
+	if _, err := io.ReadFull(conn, head[1:]); err != nil {
 		log.Println("接受协议数据失败！", err)
 		return Protocol{Result: protocolResultFailToReceive}
 	}
+	if err := readFrameBody(conn, binary.BigEndian.Uint32(head[:]), &protocol); err != nil {
+		log.Println("接受协议数据失败！", err)
+		return Protocol{Result: protocolResultFailToReceive}
+	}
+	return protocol
+}
 
-	return parseProtocol(body)
+// 代理映射需要的功能，指定访问端口的TCP代理不需要协商
+func requiredCapabilities(proxyType string, port uint32) []string {
+	var capabilities []string
+	switch proxyType {
+	case config.ProxyTypeUDP:
+		capabilities = append(capabilities, capabilityUDP)
+	case config.ProxyTypeHTTP:
+		return []string{capabilityHTTP}
+	case config.ProxyTypeHTTPS:
+		return []string{capabilityHTTPS}
+	}
+	if port == 0 {
+		capabilities = append(capabilities, capabilityAutoPort)
+	}
+	return capabilities
+}
+
+// 是否包含指定功能
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// 双方都支持的功能
+func intersectCapabilities(a []string, b []string) []string {
+	var result []string
+	for _, c := range a {
+		if hasCapability(b, c) && !hasCapability(result, c) {
+			result = append(result, c)
+		}
+	}
+	return result
 }
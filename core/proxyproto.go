@@ -0,0 +1,102 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/aulang/netbus/config"
+	"net"
+)
+
+// PROXY protocol v2 签名
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// 访问者信息，代理需要 PROXY protocol 时服务端在工作连接上先发送该帧
+type visitorInfo struct {
+	SrcAddr string `json:"src_addr"` // 访问者地址
+	DstAddr string `json:"dst_addr"` // 访问者连接的服务端地址
+}
+
+// 发送访问者信息
+func sendVisitorInfo(clientConn net.Conn, visitorConn net.Conn) bool {
+	info := visitorInfo{
+		SrcAddr: visitorConn.RemoteAddr().String(),
+		DstAddr: visitorConn.LocalAddr().String(),
+	}
+	if err := writeFrame(clientConn, info); err != nil {
+		closeWithoutError(clientConn)
+		return false
+	}
+	return true
+}
+
+// 接收访问者信息
+func receiveVisitorInfo(serverConn net.Conn) (visitorInfo, error) {
+	var info visitorInfo
+	var length uint32
+	if err := binary.Read(serverConn, binary.BigEndian, &length); err != nil {
+		return info, err
+	}
+	err := readFrameBody(serverConn, length, &info)
+	return info, err
+}
+
+// 生成 PROXY protocol 头，地址无法解析时生成不含地址的头，本地服务使用连接本身的地址
+func proxyProtocolHeader(version string, info visitorInfo) []byte {
+	src, srcErr := net.ResolveTCPAddr("tcp", info.SrcAddr)
+	dst, dstErr := net.ResolveTCPAddr("tcp", info.DstAddr)
+	if srcErr != nil || dstErr != nil {
+		src, dst = nil, nil
+	}
+	if version == config.ProxyProtocolV2 {
+		return proxyProtocolV2Header(src, dst)
+	}
+	return proxyProtocolV1Header(src, dst)
+}
+
+// PROXY protocol v1 文本格式，IPv4 与 IPv6 混用时地址未知
+func proxyProtocolV1Header(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		if src.IP.To4() != nil || dst.IP.To4() != nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+// PROXY protocol v2 二进制格式，IPv4 与 IPv6 混用时地址未知
+func proxyProtocolV2Header(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+	// 版本2，PROXY 命令
+	buf.WriteByte(0x21)
+
+	if src == nil || dst == nil || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		// 未知地址
+		buf.WriteByte(0x00)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(0))
+		return buf.Bytes()
+	}
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP != nil {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(12))
+	} else {
+		// TCP over IPv6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		buf.WriteByte(0x21)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(36))
+	}
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
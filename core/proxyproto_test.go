@@ -0,0 +1,70 @@
+package core
+
+import (
+	"bytes"
+	"github.com/aulang/netbus/config"
+	"testing"
+)
+
+// PROXY protocol 头按规范逐字节比较，IPv4 与 IPv6 混用及地址无法解析时地址未知
+func TestProxyProtocolHeader(t *testing.T) {
+	signature := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name string
+		src  string
+		dst  string
+		v1   string
+		v2   string
+	}{
+		{
+			name: "IPv4",
+			src:  "192.168.1.10:56324",
+			dst:  "10.0.0.1:443",
+			v1:   "PROXY TCP4 192.168.1.10 10.0.0.1 56324 443\r\n",
+			v2: signature + "\x21\x11\x00\x0c" +
+				"\xc0\xa8\x01\x0a" + "\x0a\x00\x00\x01" +
+				"\xdc\x04" + "\x01\xbb",
+		},
+		{
+			name: "IPv6",
+			src:  "[2001:db8::1]:56324",
+			dst:  "[::1]:443",
+			v1:   "PROXY TCP6 2001:db8::1 ::1 56324 443\r\n",
+			v2: signature + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xdc\x04" + "\x01\xbb",
+		},
+		{
+			name: "IPv4 访问 IPv6",
+			src:  "192.168.1.10:56324",
+			dst:  "[::1]:443",
+			v1:   "PROXY UNKNOWN\r\n",
+			v2:   signature + "\x21\x00\x00\x00",
+		},
+		{
+			name: "IPv6 访问 IPv4",
+			src:  "[2001:db8::1]:56324",
+			dst:  "10.0.0.1:443",
+			v1:   "PROXY UNKNOWN\r\n",
+			v2:   signature + "\x21\x00\x00\x00",
+		},
+		{
+			name: "地址无法解析",
+			src:  "unknown",
+			dst:  "10.0.0.1:443",
+			v1:   "PROXY UNKNOWN\r\n",
+			v2:   signature + "\x21\x00\x00\x00",
+		},
+	}
+
+	for _, test := range tests {
+		info := visitorInfo{SrcAddr: test.src, DstAddr: test.dst}
+		if header := proxyProtocolHeader(config.ProxyProtocolV1, info); string(header) != test.v1 {
+			t.Errorf("%s：v1 头为 %q，期望 %q", test.name, header, test.v1)
+		}
+		if header := proxyProtocolHeader(config.ProxyProtocolV2, info); !bytes.Equal(header, []byte(test.v2)) {
+			t.Errorf("%s：v2 头为 % x，期望 % x", test.name, header, test.v2)
+		}
+	}
+}
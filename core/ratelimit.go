@@ -0,0 +1,206 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 令牌桶限速器，速率为0时不限速，可在使用中修改速率
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // 每秒字节数
+	burst  float64 // 桶容量
+	tokens float64 // 剩余令牌，预支时为负数
+	last   time.Time
+}
+
+// 创建时桶是满的，开始时即可突发
+func newRateLimiter(limit config.RateLimit) *rateLimiter {
+	l := &rateLimiter{last: time.Now()}
+	l.setLimit(limit)
+	return l
+}
+
+// 修改速率，桶容量增加时补充增加的令牌，剩余令牌不超过新的桶容量
+func (l *rateLimiter) setLimit(limit config.RateLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// 修改之前按原速率补充令牌，避免之前的时间按新速率计算
+	l.refill()
+	burst := float64(limit.BurstOrRate())
+	if burst > l.burst {
+		l.tokens += burst - l.burst
+	}
+	l.rate = float64(limit.Rate)
+	l.burst = burst
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// 单次读取的最大字节数，避免一次等待过久
+func (l *rateLimiter) chunkSize(size int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate > 0 && l.burst >= 1 && float64(size) > l.burst {
+		return int(l.burst)
+	}
+	return size
+}
+
+// 取得 n 个令牌，不足时预支并等待补足
+func (l *rateLimiter) wait(n int) {
+	if delay, _ := l.reserve(n, -1); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// 预支 n 个令牌，返回需要等待的时间
+// maxWait 不小于0时，需要等待的时间超过 maxWait 则不预支并返回 false
+func (l *rateLimiter) reserve(n int, maxWait time.Duration) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return 0, true
+	}
+
+	l.refill()
+	var delay time.Duration
+	if remaining := l.tokens - float64(n); remaining < 0 {
+		delay = time.Duration(-remaining / l.rate * float64(time.Second))
+	}
+	if maxWait >= 0 && delay > maxWait {
+		return delay, false
+	}
+	l.tokens -= float64(n)
+	return delay, true
+}
+
+// 按速率补充上次补充之后的令牌，不超过桶容量，需持有 mutex
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// 归还预支但未使用的 n 个令牌，剩余令牌不超过桶容量
+func (l *rateLimiter) refund(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// 双向限速器，两个方向分别限速
+type bandwidth struct {
+	in  *rateLimiter // 访问者发送给内网服务
+	out *rateLimiter // 内网服务返回给访问者
+}
+
+func newBandwidth(limit config.RateLimit) *bandwidth {
+	return &bandwidth{in: newRateLimiter(limit), out: newRateLimiter(limit)}
+}
+
+// 修改双向速率
+func (b *bandwidth) setLimit(limit config.RateLimit) {
+	b.in.setLimit(limit)
+	b.out.setLimit(limit)
+}
+
+// 单方向的转发控制，记录转发的字节数并按限速等待，为空时不记录也不限速
+type flow struct {
+	counter  *int64 // 为空时不记录
+	limiters []*rateLimiter
+}
+
+// 访问统计及限速对应的双向转发控制
+// stats 为空且不限速时返回空，转发时可以使用 WriterTo、ReaderFrom
+func newFlows(stats *tunnelStats, bandwidths []*bandwidth) (in *flow, out *flow) {
+	if stats == nil && len(bandwidths) == 0 {
+		return nil, nil
+	}
+	in, out = &flow{}, &flow{}
+	if stats != nil {
+		in.counter, out.counter = &stats.bytesIn, &stats.bytesOut
+	}
+	for _, b := range bandwidths {
+		in.limiters = append(in.limiters, b.in)
+		out.limiters = append(out.limiters, b.out)
+	}
+	return in, out
+}
+
+// 单次读取的最大字节数
+func (f *flow) chunkSize(size int) int {
+	for _, limiter := range f.limiters {
+		size = limiter.chunkSize(size)
+	}
+	return size
+}
+
+// 按限速等待发送 n 个字节
+func (f *flow) wait(n int) {
+	if f == nil {
+		return
+	}
+	for _, limiter := range f.limiters {
+		limiter.wait(n)
+	}
+}
+
+// 记录已发送的字节数
+func (f *flow) add(n int) {
+	if f != nil && f.counter != nil && n > 0 {
+		atomic.AddInt64(f.counter, int64(n))
+	}
+}
+
+// 客户端共享的限速及连接数限制
+type clientLimiter struct {
+	bandwidth *bandwidth
+	conns     *connLimiter
+}
+
+// 客户端共享的限制，同一密钥或者证书身份的所有代理共享，配置修改时更新
+func (s *Server) clientLimiter(identity string, key string) *clientLimiter {
+	limitIdentity := config.ClientLimitIdentity(identity, key)
+	if value, exists := s.clientLimiters.Load(limitIdentity); exists {
+		return value.(*clientLimiter)
+	}
+	cfg := s.config()
+	value, _ := s.clientLimiters.LoadOrStore(limitIdentity, &clientLimiter{
+		bandwidth: newBandwidth(cfg.ClientRateLimitOf(identity, key)),
+		conns:     newConnLimiter(cfg.ClientConnLimitOf(identity, key)),
+	})
+	return value.(*clientLimiter)
+}
+
+// 按新配置更新所有客户端的限速及连接数限制
+func (s *Server) updateClientLimiters(cfg config.ServerConfig) {
+	s.clientLimiters.Range(func(key, value interface{}) bool {
+		identity := key.(string)
+		rateLimit, exists := cfg.ClientRateLimits[identity]
+		if !exists {
+			rateLimit = cfg.ClientRateLimit
+		}
+		connLimit, exists := cfg.ClientConnLimits[identity]
+		if !exists {
+			connLimit = cfg.ClientConnLimit
+		}
+		limiter := value.(*clientLimiter)
+		limiter.bandwidth.setLimit(rateLimit)
+		limiter.conns.setLimit(connLimit)
+		return true
+	})
+}
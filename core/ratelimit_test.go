@@ -0,0 +1,74 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"testing"
+	"time"
+)
+
+// 预支令牌：桶满时立即通过，不足时按速率计算等待时间，超过最长等待时间时不预支
+func TestRateLimiterReserve(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimit{Rate: 1000, Burst: 1000})
+
+	if delay, ok := limiter.reserve(1000, 0); !ok || delay != 0 {
+		t.Fatal("创建时桶不是满的", delay, ok)
+	}
+	if delay, ok := limiter.reserve(500, 100*time.Millisecond); ok {
+		t.Fatal("等待时间超过最长等待时间时仍预支", delay)
+	}
+	delay, ok := limiter.reserve(500, -1)
+	if !ok || delay < 450*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatal("等待时间不对", delay, ok)
+	}
+	limiter.refund(500)
+	if delay, _ := limiter.reserve(0, -1); delay > 0 {
+		t.Fatal("归还之后仍需等待", delay)
+	}
+}
+
+// 修改速率：桶容量增加时补充增加的令牌，减少时剩余令牌不超过新的容量，速率为0时不限速
+func TestRateLimiterSetLimit(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimit{Rate: 1000, Burst: 1000})
+	limiter.reserve(1000, -1)
+
+	limiter.setLimit(config.RateLimit{Rate: 1000, Burst: 3000})
+	if delay, ok := limiter.reserve(2000, 0); !ok || delay != 0 {
+		t.Fatal("桶容量增加时未补充令牌", delay, ok)
+	}
+
+	limiter = newRateLimiter(config.RateLimit{Rate: 1000, Burst: 3000})
+	limiter.setLimit(config.RateLimit{Rate: 1000, Burst: 1000})
+	if _, ok := limiter.reserve(2000, 500*time.Millisecond); ok {
+		t.Fatal("桶容量减少时剩余令牌超过新的容量")
+	}
+
+	limiter.setLimit(config.RateLimit{})
+	if delay, ok := limiter.reserve(1<<30, 0); !ok || delay != 0 {
+		t.Fatal("速率为0时仍限速", delay, ok)
+	}
+}
+
+// 按速率发送，突发之外的字节数按速率等待，修改速率之后按新的速率发送
+func TestRateLimiterThroughput(t *testing.T) {
+	send := func(limiter *rateLimiter, total int) time.Duration {
+		start := time.Now()
+		for sent := 0; sent < total; {
+			n := limiter.chunkSize(total - sent)
+			limiter.wait(n)
+			sent += n
+		}
+		return time.Since(start)
+	}
+
+	// 突发 1000 字节，之后 2000 字节按每秒 10000 字节发送
+	limiter := newRateLimiter(config.RateLimit{Rate: 10000, Burst: 1000})
+	if elapsed := send(limiter, 3000); elapsed < 180*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatal("发送耗时超出误差范围", elapsed)
+	}
+
+	// 速率提高一倍，耗时减半
+	limiter.setLimit(config.RateLimit{Rate: 20000, Burst: 1000})
+	if elapsed := send(limiter, 4000); elapsed < 180*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatal("修改速率之后发送耗时超出误差范围", elapsed)
+	}
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"fmt"
+	"github.com/aulang/netbus/config"
+	"log"
+)
+
+// 重新加载服务端配置，只影响修改的部分
+// 密钥、访问端口范围、心跳、停止超时时间、客户端限速、连接数限制、管理接口及监控指标令牌立即生效，不再满足新配置的客户端及代理端口随之关闭
+// 只允许挑战应答认证对之后的握手生效，已连接的客户端不受影响
+// 客户端凭据立即生效，凭据修改或者删除的客户端断开重连，归其他客户端所有的代理随之关闭
+// 吊销列表文件重新读取，已吊销密钥的客户端随之断开
+// 桥接端口、监听地址、TLS、域名代理共享端口、管理接口、监控指标地址及吊销列表文件路径需要重启才能生效
+func (s *Server) Reload(cfg config.ServerConfig) error {
+	cfg.Heartbeat.SetDefaults()
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = config.DefaultDrainTimeout
+	}
+	if err := cfg.Heartbeat.Check(); err != nil {
+		return fmt.Errorf("心跳配置错误：%w", err)
+	}
+
+	s.cfgMutex.Lock()
+	old := s.cfg
+	if cfg.Port != old.Port || cfg.TLS != old.TLS || cfg.HTTPPort != old.HTTPPort || cfg.HTTPSPort != old.HTTPSPort ||
+		cfg.AdminAddr != old.AdminAddr || cfg.MetricsAddr != old.MetricsAddr ||
+		cfg.BindAddr != old.BindAddr || cfg.ProxyBindAddr != old.ProxyBindAddr || cfg.RevocationFile != old.RevocationFile {
+		log.Println("桥接端口、监听地址、TLS、域名代理共享端口、管理接口、监控指标地址及吊销列表文件路径的修改需要重启服务端才能生效")
+		cfg.Port, cfg.TLS, cfg.HTTPPort, cfg.HTTPSPort = old.Port, old.TLS, old.HTTPPort, old.HTTPSPort
+		cfg.AdminAddr, cfg.MetricsAddr = old.AdminAddr, old.MetricsAddr
+		cfg.BindAddr, cfg.ProxyBindAddr = old.BindAddr, old.ProxyBindAddr
+		cfg.RevocationFile = old.RevocationFile
+	}
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" && !loopbackAddr(cfg.AdminAddr) {
+		log.Println("管理接口监听非本机地址时须配置访问令牌，继续使用原访问令牌")
+		cfg.AdminToken = old.AdminToken
+	}
+	if cfg.MetricsAddr != "" && cfg.MetricsToken == "" && !loopbackAddr(cfg.MetricsAddr) {
+		log.Println("监控指标端口监听非本机地址时须配置访问令牌，继续使用原访问令牌")
+		cfg.MetricsToken = old.MetricsToken
+	}
+	s.cfg = cfg
+	s.cfgMutex.Unlock()
+	log.Println("已重新加载服务端配置：", cfg)
+
+	// 客户端限速及连接数限制立即生效
+	s.updateClientLimiters(cfg)
+
+	if err := s.loadRevocations(); err != nil {
+		log.Println("加载密钥吊销列表失败！", err)
+	}
+
+	// 密钥或者客户端凭据已修改，断开无法通过新配置认证的客户端，证书认证的客户端不受影响
+	// 凭据修改之后允许的访问端口及域名可能不同，使用该凭据的客户端重新连接
+	credentialsChanged := !credentialsEqual(cfg.Credentials, old.Credentials)
+	if cfg.Key != old.Key || credentialsChanged {
+		s.sessions.Range(func(key, value interface{}) bool {
+			session := key.(*clientSession)
+			if session.identity != "" {
+				return true
+			}
+			_, valid := cfg.CheckKeyToken(session.key)
+			if id, ok := config.CredentialID(session.key); ok {
+				valid = cfg.Credentials[id].Equal(old.Credentials[id])
+			}
+			if !valid {
+				log.Printf("密钥已失效，断开客户端：[%s]\n", session.String())
+				session.close()
+			}
+			return true
+		})
+		// 旧版客户端的代理通道
+		s.tunnels.Range(func(key, value interface{}) bool {
+			tunnel := value.(*ClientTunnel)
+			if tunnel.session == nil && tunnel.identity == "" && !checkKey(cfg.Key, tunnel.protocol.Key) {
+				log.Printf("密钥已失效，关闭代理端口：[%d]\n", tunnel.protocol.Port)
+				tunnel.close()
+			}
+			return true
+		})
+	}
+
+	// 客户端凭据已修改，关闭归其他客户端所有的代理端口及域名代理
+	if credentialsChanged {
+		s.tunnels.Range(func(key, value interface{}) bool {
+			tunnel := value.(*ClientTunnel)
+			if !s.tunnelReserved(cfg, tunnel) {
+				return true
+			}
+			log.Printf("访问端口或者域名归其他客户端所有，关闭代理：[%d]\n", tunnel.proxyPort())
+			if tunnel.session != nil {
+				tunnel.session.removeTunnel(tunnel.protocol.Port)
+			} else {
+				tunnel.close()
+			}
+			return true
+		})
+	}
+
+	// 访问端口范围已修改，关闭范围之外的代理端口，域名代理不受影响
+	if cfg.MinProxyPort != old.MinProxyPort || cfg.MaxProxyPort != old.MaxProxyPort {
+		s.tunnels.Range(func(key, value interface{}) bool {
+			tunnel := value.(*ClientTunnel)
+			if len(tunnel.domains) == 0 && !cfg.PortInRange(tunnel.proxyPort()) {
+				log.Printf("访问端口不在允许范围内，关闭代理端口：[%d]\n", tunnel.proxyPort())
+				if tunnel.session != nil {
+					tunnel.session.removeTunnel(tunnel.protocol.Port)
+				} else {
+					tunnel.close()
+				}
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// 客户端凭据是否相同
+func credentialsEqual(a map[string]config.ClientCredential, b map[string]config.ClientCredential) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, credential := range a {
+		if other, exists := b[id]; !exists || !credential.Equal(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// 通道的访问端口或者域名是否归其他客户端所有
+func (s *Server) tunnelReserved(cfg config.ServerConfig, tunnel *ClientTunnel) bool {
+	var owner string
+	if tunnel.session != nil {
+		owner = tunnel.session.ownerID()
+	} else if tunnel.identity != "" {
+		owner = tunnel.identity
+	} else {
+		claims, _ := config.ParseKey(cfg.Key, tunnel.protocol.Key)
+		owner = claims.ClientID
+	}
+
+	if tunnel.group != nil {
+		identity := config.ClientLimitIdentity(tunnel.identity, tunnel.session.key)
+		return cfg.GroupPortReserved(tunnel.group.port, owner) || !tunnel.group.allowJoin(cfg, identity, owner)
+	}
+	if len(tunnel.domains) == 0 {
+		return cfg.PortReserved(tunnel.protocol.Port, owner)
+	}
+	for _, domain := range tunnel.domains {
+		if cfg.DomainReserved(domain, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// 重新加载客户端配置，只影响修改的部分
+// 代理映射的修改在当前会话中生效，未修改的代理不受影响
+// 密钥、客户端编号、服务端地址、TLS及心跳配置修改时重新连接服务端，监控指标地址及访问令牌需要重启才能生效
+func (c *Client) Reload(cfg config.ClientConfig) error {
+	cfg.Heartbeat.SetDefaults()
+	if err := cfg.Heartbeat.Check(); err != nil {
+		return fmt.Errorf("心跳配置错误：%w", err)
+	}
+
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	c.mutex.Lock()
+	old, tlsConfig := c.cfg, c.tlsConfig
+	c.mutex.Unlock()
+
+	if cfg.MetricsAddr != old.MetricsAddr || cfg.MetricsToken != old.MetricsToken {
+		log.Println("监控指标地址及访问令牌的修改需要重启客户端才能生效")
+		cfg.MetricsAddr, cfg.MetricsToken = old.MetricsAddr, old.MetricsToken
+	}
+
+	reconnect := cfg.Key != old.Key || cfg.ClientID != old.ClientID || cfg.ServerAddr.String() != old.ServerAddr.String() ||
+		cfg.TLS != old.TLS || cfg.Heartbeat != old.Heartbeat
+	if reconnect {
+		tlsConfig = nil
+		if cfg.TLS.ClientEnabled() {
+			var err error
+			if tlsConfig, err = cfg.TLS.ClientTLSConfig(cfg.ServerAddr.Host); err != nil {
+				return fmt.Errorf("加载TLS配置失败：%w", err)
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	c.cfg, c.tlsConfig = cfg, tlsConfig
+	session := c.session
+	c.mutex.Unlock()
+	log.Println("已重新加载配置：", cfg)
+
+	if reconnect {
+		log.Println("连接配置已修改，重新连接服务端")
+		if session != nil {
+			closeWithoutError(session)
+		}
+		return nil
+	}
+
+	// 只保留最新的代理映射，由当前会话更新，没有会话时在下次连接时生效
+	select {
+	case <-c.reload:
+	default:
+	}
+	c.reload <- cfg.ProxyAddrs
+	return nil
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"github.com/aulang/netbus/config"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 检查吊销列表文件修改的间隔
+const revocationWatchInterval = 2 * time.Second
+
+// 密钥吊销列表
+// 按密钥编号吊销，旧版密钥、超级密钥及客户端凭据没有编号，不能吊销
+// 旧版密钥由种子及过期日期确定，其指纹可用于离线猜测种子，因此不使用指纹作为编号
+type revocationList struct {
+	mutex sync.RWMutex
+	ids   map[string]bool
+}
+
+// 密钥是否已吊销
+func (l *revocationList) revoked(id string) bool {
+	if id == "" {
+		return false
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.ids[id]
+}
+
+// 所有已吊销的密钥编号
+func (l *revocationList) list() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	ids := make([]string, 0, len(l.ids))
+	for id := range l.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// 从吊销列表文件加载，未配置文件时不处理
+func (s *Server) loadRevocations() error {
+	path := s.config().RevocationFile
+	if path == "" {
+		return nil
+	}
+	ids, err := config.LoadRevocationList(path)
+	if err != nil {
+		return err
+	}
+
+	s.revocations.mutex.Lock()
+	s.revocations.ids = ids
+	s.revocations.mutex.Unlock()
+	log.Printf("已加载密钥吊销列表：[%s]，共 %d 个\n", path, len(ids))
+
+	s.closeRevoked()
+	return nil
+}
+
+// 监听吊销列表文件修改并重新加载，服务端停止时返回
+func (s *Server) watchRevocations(path string) {
+	defer s.wg.Done()
+
+	changed := config.WatchFile(path, revocationWatchInterval, s.done)
+	for {
+		select {
+		case <-changed:
+			if err := s.loadRevocations(); err != nil {
+				log.Println("加载密钥吊销列表失败！", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// 修改吊销列表，配置了吊销列表文件时先保存到文件，保存失败时不修改
+// revoke 为 false 时取消吊销，密钥编号不在列表中时返回 false
+func (s *Server) setRevoked(id string, revoke bool) (bool, error) {
+	path := s.config().RevocationFile
+
+	s.revocations.mutex.Lock()
+	if s.revocations.ids[id] == revoke {
+		s.revocations.mutex.Unlock()
+		return revoke, nil
+	}
+	ids := make(map[string]bool, len(s.revocations.ids)+1)
+	for revokedID := range s.revocations.ids {
+		ids[revokedID] = true
+	}
+	if revoke {
+		ids[id] = true
+	} else {
+		delete(ids, id)
+	}
+	if path != "" {
+		if err := config.SaveRevocationList(path, ids); err != nil {
+			s.revocations.mutex.Unlock()
+			return false, err
+		}
+	}
+	s.revocations.ids = ids
+	s.revocations.mutex.Unlock()
+
+	if revoke {
+		s.closeRevoked()
+	}
+	return true, nil
+}
+
+// 密钥是否已吊销，证书认证的客户端没有密钥
+func (s *Server) keyRevoked(claims config.KeyClaims) bool {
+	return s.revocations.revoked(claims.ID)
+}
+
+// 断开密钥已吊销的客户端，尚未设置控制连接的会话由 handleControlConn 在设置之后再次检查
+func (s *Server) closeRevoked() {
+	s.sessions.Range(func(key, value interface{}) bool {
+		session := key.(*clientSession)
+		session.mutex.Lock()
+		revoked := session.identity == "" && s.keyRevoked(session.claims)
+		session.mutex.Unlock()
+		if revoked {
+			log.Printf("密钥已吊销，断开客户端：[%s]\n", session.String())
+			session.close()
+		}
+		return true
+	})
+	// 旧版客户端的代理通道
+	serverKey := s.config().Key
+	s.tunnels.Range(func(key, value interface{}) bool {
+		tunnel := value.(*ClientTunnel)
+		if tunnel.session != nil || tunnel.identity != "" {
+			return true
+		}
+		claims, _ := config.ParseKey(serverKey, tunnel.protocol.Key)
+		if s.keyRevoked(claims) {
+			log.Printf("密钥已吊销，关闭代理端口：[%d]\n", tunnel.protocol.Port)
+			tunnel.close()
+		}
+		return true
+	})
+}
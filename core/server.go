@@ -1,147 +1,1185 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/aulang/netbus/config"
+	"github.com/hashicorp/yamux"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 等待客户端建立工作连接的超时时间
+	workConnTimeout = 10 * time.Second
 )
 
 // 客户端通道
 type ClientTunnel struct {
-	protocol Protocol      // 请求信息
-	connChan chan net.Conn // 会话连接池
+	stats      tunnelStats    // 访问统计
+	protocol   Protocol       // 请求信息
+	name       string         // 客户端注册的代理名称，旧版客户端为空
+	remoteAddr net.Addr       // 旧版客户端地址，新版客户端使用会话地址
+	createdAt  time.Time      // 创建时间
+	proxyType  string         // 代理类型
+	identity   string         // 客户端证书身份，使用密钥认证时为空
+	owner      string         // 旧版客户端的标识，只有同一客户端可以向通道放入连接
+	connChan   chan net.Conn  // 会话连接池
+	server     *Server        // 所属服务端
+	session    *clientSession // 所属客户端会话，旧版客户端为空
+	bindAddr   string         // 代理端口监听地址，为空时监听所有地址
+	listener   net.Listener   // TCP代理端口监听
+	packetConn net.PacketConn // UDP代理端口监听
+	domains    []string       // 访问域名，仅域名代理使用
+	group      *tunnelGroup   // 所属负载均衡组，不为空时共享组的访问端口
+	bandwidths []*bandwidth   // 限速，包括客户端共享的限速及代理自身的限速
+	// 连接数限制，代理自身的限制在前，客户端共享的限制在后
+	connLimiters []*connLimiter
+	ipFilter     config.IPFilter // 客户端请求的访问地址过滤，服务端配置的过滤另外检查
+	// 客户端向本地服务发送的 PROXY protocol 版本，不为空时工作连接先发送访问者信息
+	proxyProtocol string
+	done          chan struct{} // 通道关闭通知
+	closeOnce     sync.Once
 }
 
-var (
+// 服务端，可在同一进程中创建多个
+type Server struct {
+	cfg       config.ServerConfig // 重新加载时更新，通过 config 读取
+	cfgMutex  sync.RWMutex
+	tlsConfig *tls.Config // 桥接端口TLS配置，未启用时为空
+
 	// key:   proxyPort
-	// value: ClientTunnel
-	clientTunnelMap   sync.Map
-	clientTunnelMutex sync.Mutex
-)
+	// value: *ClientTunnel
+	tunnels     sync.Map
+	tunnelMutex sync.Mutex
 
-// 检查请求信息，返回结果
-func checkProtocol(protocol Protocol, cfg config.ServerConfig) byte {
-	// 检查版本号
-	if protocol.Version != protocolVersion {
-		log.Println("版本号不匹配！", protocol.String())
-		return protocolResultVersionMismatch
+	// key:   domain
+	// value: *ClientTunnel
+	httpDomains  sync.Map
+	httpsDomains sync.Map
+
+	// key:   proxyPort
+	// value: *tunnelGroup
+	groups sync.Map
+
+	// 域名通道没有独立的访问端口，使用大于 65535 的虚拟端口作为通道编号
+	lastVirtualPort uint32
+
+	// 最近一次分配的访问端口，下次从其后开始分配，避免刚释放的端口立即被复用
+	lastAssignedPort uint32
+
+	// key:   *clientSession
+	sessions sync.Map
+
+	// key:   config.ClientLimitIdentity
+	// value: *clientLimiter
+	clientLimiters sync.Map
+
+	// 最近一次分配的会话编号
+	lastSessionID uint64
+
+	// 已吊销的密钥
+	revocations revocationList
+
+	// 进行中的访问连接数
+	activeConns int64
+
+	metrics *metrics // 握手结果统计
+
+	mutex         sync.Mutex
+	listeners     []io.Closer  // 桥接端口及域名代理共享端口监听
+	admin         *http.Server // 管理接口，未启用时为空
+	metricsServer *http.Server // 监控指标端口，未启用时为空
+	started       bool
+	drain         chan struct{} // 开始优雅停止通知
+	drainOnce     sync.Once
+	done          chan struct{} // 服务端停止通知
+	stopOnce      sync.Once
+	wg            sync.WaitGroup
+}
+
+// 创建服务端
+func NewServer(cfg config.ServerConfig) *Server {
+	cfg.Heartbeat.SetDefaults()
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = config.DefaultDrainTimeout
 	}
-	// 检查密钥
-	if _, ok := config.CheckKey(cfg.Key, protocol.Key); !ok {
-		log.Println("认证失败！", protocol.String())
-		return protocolResultFailToAuth
+	return &Server{
+		cfg:             cfg,
+		lastVirtualPort: 65535,
+		metrics:         newMetrics(),
+		drain:           make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// 当前配置
+func (s *Server) config() config.ServerConfig {
+	s.cfgMutex.RLock()
+	defer s.cfgMutex.RUnlock()
+	return s.cfg
+}
+
+// 分配虚拟端口
+func (s *Server) nextVirtualPort() uint32 {
+	return atomic.AddUint32(&s.lastVirtualPort, 1)
+}
+
+// 创建客户端通道，并在 bindAddr 上监听代理端口，bindAddr 为空时监听所有地址
+func (s *Server) newClientTunnel(protocol Protocol, proxyType string, identity string, session *clientSession, bindAddr string) (*ClientTunnel, error) {
+	clientTunnel := s.newTunnel(protocol, proxyType, identity, session, bindAddr)
+
+	var err error
+	switch proxyType {
+	case config.ProxyTypeUDP:
+		clientTunnel.packetConn, err = listenUDP(bindAddr, protocol.Port)
+	case config.ProxyTypeTCP:
+		clientTunnel.listener, err = listen(bindAddr, protocol.Port)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clientTunnel, nil
+}
+
+// 创建客户端通道，不监听代理端口，域名代理及负载均衡组成员共享其他端口
+func (s *Server) newTunnel(protocol Protocol, proxyType string, identity string, session *clientSession, bindAddr string) *ClientTunnel {
+	clientTunnel := &ClientTunnel{
+		server:    s,
+		bindAddr:  bindAddr,
+		protocol:  protocol,
+		proxyType: proxyType,
+		identity:  identity,
+		connChan:  make(chan net.Conn),
+		session:   session,
+		createdAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	limiter := s.clientLimiter(identity, protocol.Key)
+	clientTunnel.bandwidths = []*bandwidth{limiter.bandwidth}
+	clientTunnel.connLimiters = []*connLimiter{limiter.conns}
+	return clientTunnel
+}
+
+// 设置客户端注册的代理名称、代理自身的限速、连接数限制、访问地址过滤及 PROXY protocol，通道开始使用之前调用
+func (t *ClientTunnel) setMapping(message Message) {
+	t.name = message.Name
+	rateLimit := config.RateLimit{Rate: message.Rate, Burst: message.Burst}
+	if rateLimit.Enabled() && hasCapability(t.session.capabilities, capabilityRateLimit) {
+		t.bandwidths = append(t.bandwidths, newBandwidth(rateLimit))
+		log.Printf("代理已限速：[%s]，%s\n", message.Name, rateLimit.String())
+	}
+	connLimit := message.connLimit()
+	if connLimit.Enabled() && hasCapability(t.session.capabilities, capabilityConnLimit) {
+		t.connLimiters = append([]*connLimiter{newConnLimiter(connLimit)}, t.connLimiters...)
+		log.Printf("代理已限制连接数：[%s]，%s\n", message.Name, connLimit.String())
+	}
+	if hasCapability(t.session.capabilities, capabilityIPFilter) {
+		// 注册时已检查格式
+		t.ipFilter, _ = config.ParseIPFilter(message.Allow, message.Deny)
+		if t.ipFilter.Enabled() {
+			log.Printf("代理已过滤访问地址：[%s]，%s\n", message.Name, t.ipFilter.String())
+		}
+	}
+	if hasCapability(t.session.capabilities, capabilityProxyProtocol) {
+		t.proxyProtocol = message.ProxyProtocol
+	}
+}
+
+// 关闭通道，停止监听代理端口
+func (t *ClientTunnel) close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		closeWithoutError(t.listener, t.packetConn)
+		t.server.tunnels.Delete(t.protocol.Port)
+		if t.group != nil {
+			t.group.remove(t)
+			return
+		}
+		if len(t.domains) > 0 {
+			for _, domain := range t.domains {
+				t.server.domainMap(t.proxyType).Delete(domain)
+			}
+			log.Printf("已关闭域名代理：%v\n", t.domains)
+			return
+		}
+		log.Printf("已关闭代理端口：[%d]\n", t.protocol.Port)
+	})
+}
+
+// 访问端口，负载均衡组成员为组的访问端口，域名代理为域名代理共享端口
+func (t *ClientTunnel) proxyPort() uint32 {
+	switch {
+	case t.group != nil:
+		return t.group.port
+	case len(t.domains) > 0 && t.proxyType == config.ProxyTypeHTTPS:
+		return t.server.config().HTTPSPort
+	case len(t.domains) > 0:
+		return t.server.config().HTTPPort
+	}
+	return t.protocol.Port
+}
+
+// 是否使用虚拟端口，域名代理及负载均衡组成员共享其他端口，虚拟端口只用于区分通道
+func (t *ClientTunnel) virtual() bool {
+	return t.group != nil || len(t.domains) > 0
+}
+
+// 通道是否已关闭
+func (t *ClientTunnel) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 客户端会话，对应一条多路复用的桥接连接
+type clientSession struct {
+	id           uint64           // 会话编号，用于管理接口
+	identity     string           // 客户端证书身份
+	connectedAt  time.Time        // 连接时间
+	session      *yamux.Session   // 多路复用会话
+	control      *controlConn     // 控制连接
+	key          string           // 客户端密钥的公开部分，设置控制连接时确定，之后只读
+	claims       config.KeyClaims // 密钥声明，设置控制连接时确定，之后只读，证书认证及超级密钥为空
+	capabilities []string         // 协商后的功能，设置控制连接时确定，之后只读
+	mutex        sync.Mutex
+	closed       bool
+	tunnels      []*ClientTunnel // 已注册的代理通道
+}
+
+// 客户端名称，用于日志
+func (s *clientSession) String() string {
+	if s.identity != "" {
+		return s.identity
+	}
+	if s.claims.ClientID != "" {
+		return s.claims.ClientID + "@" + s.session.RemoteAddr().String()
+	}
+	return s.session.RemoteAddr().String()
+}
+
+// 设置控制连接、客户端密钥、密钥声明及协商后的功能，每个会话只允许一条控制连接
+func (s *clientSession) setControl(control *controlConn, key string, claims config.KeyClaims, capabilities []string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.control != nil {
+		return false
+	}
+	s.control = control
+	s.key = key
+	s.claims = claims
+	s.capabilities = capabilities
+	return true
+}
+
+// 控制连接是否已通过认证，之后会话中的工作连接无需再次认证
+func (s *clientSession) authenticated() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.control != nil && !s.closed
+}
+
+// 客户端编号，用于判断访问端口及域名的归属
+func (s *clientSession) ownerID() string {
+	return ownerID(s.identity, s.claims)
+}
+
+// 移除并关闭会话的代理通道
+func (s *clientSession) removeTunnel(port uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, tunnel := range s.tunnels {
+		if tunnel.protocol.Port == port {
+			s.tunnels = append(s.tunnels[:i], s.tunnels[i+1:]...)
+			tunnel.close()
+			return true
+		}
+	}
+	return false
+}
+
+// 添加代理通道，会话关闭时一并关闭
+func (s *clientSession) addTunnel(tunnel *ClientTunnel) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.tunnels = append(s.tunnels, tunnel)
+	return true
+}
+
+// 关闭会话及其所有代理通道
+func (s *clientSession) close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	tunnels := s.tunnels
+	s.tunnels = nil
+	s.mutex.Unlock()
+
+	for _, tunnel := range tunnels {
+		tunnel.close()
+	}
+	closeWithoutError(s.session)
+}
+
+// 检查请求信息，返回密钥声明及失败结果，检查通过时失败结果为空
+// identity 为已校验的客户端证书身份，不为空时无需校验密钥，密钥声明为空
+func (s *Server) checkProtocol(protocol Protocol, identity string) (config.KeyClaims, *Protocol) {
+	if protocol.Result == protocolResultFailToReceive {
+		return config.KeyClaims{}, &Protocol{Result: protocolResultFailToReceive, legacy: protocol.legacy}
+	}
+
+	cfg := s.config()
+	var claims config.KeyClaims
+	keyValid := true
+	if identity == "" {
+		if protocol.proven {
+			// 已通过挑战应答认证，只需检查公开部分
+			claims, keyValid = cfg.CheckKeyToken(protocol.Key)
+		} else {
+			claims, keyValid = config.CheckKey(cfg.Key, protocol.Key)
+		}
 	}
-	// 检查访问端口是否在允许范围内
-	if ok := cfg.PortInRange(protocol.Port); !ok {
+
+	var result Protocol
+	switch {
+	case protocol.legacy && protocol.Version != protocolVersionLegacy,
+		!protocol.legacy && protocol.Version < protocolVersionFrame:
+		// 新版格式兼容更高的版本号，新功能由功能协商决定是否启用
+		log.Println("版本号不匹配！", protocol.String())
+		result = protocol.NewError(protocolResultVersionMismatch,
+			"不支持的协议版本：%d，服务端支持版本：%d、%d 及以上", protocol.Version, protocolVersionLegacy, protocolVersionFrame)
+	case cfg.ChallengeAuthOnly && identity == "" && !protocol.proven && protocol.Key != "":
+		// 发送了密钥的请求，包括旧版客户端及使用旧版密钥的客户端
+		log.Println("客户端未使用挑战应答认证！", protocol.String())
+		result = protocol.NewError(protocolResultVersionMismatch,
+			"服务端只允许挑战应答认证，请升级客户端，旧版密钥需重新创建")
+	case !keyValid:
+		log.Println("认证失败！", protocol.String())
+		result = protocol.NewError(protocolResultFailToAuth, "密钥错误或者已过期")
+	case identity == "" && s.keyRevoked(claims):
+		log.Println("密钥已吊销！", protocol.String())
+		result = protocol.NewError(protocolResultFailToAuth, "密钥已吊销")
+	case protocol.Version == protocolVersionLegacy && !cfg.PortInRange(protocol.Port):
+		// 旧版客户端在握手时检查访问端口，新版客户端在注册代理时检查
 		log.Println("访问端口不合法！", protocol.String())
-		return protocolResultIllegalAccessPort
+		result = protocol.NewError(protocolResultIllegalAccessPort,
+			"访问端口 [%d] 不在允许范围 (%d, %d) 内", protocol.Port, cfg.MinProxyPort, cfg.MaxProxyPort)
+	case protocol.Version == protocolVersionLegacy &&
+		(!claims.AllowPort(protocol.Port) || !claims.AllowProxyType(config.ProxyTypeTCP)):
+		log.Println("密钥不允许使用该访问端口！", protocol.String())
+		result = protocol.NewError(protocolResultIllegalAccessPort, "密钥不允许使用访问端口 [%d]", protocol.Port)
+	case protocol.Version == protocolVersionLegacy && cfg.PortReserved(protocol.Port, ownerID(identity, claims)):
+		log.Println("访问端口归其他客户端所有！", protocol.String())
+		result = protocol.NewError(protocolResultIllegalAccessPort, "访问端口 [%d] 归其他客户端所有", protocol.Port)
+	default:
+		return claims, nil
+	}
+	return claims, &result
+}
+
+// 检查密钥
+func checkKey(serverKey string, clientKey string) bool {
+	_, ok := config.CheckKey(serverKey, clientKey)
+	return ok
+}
+
+// 客户端编号，用于判断访问端口及域名的归属，证书认证的客户端使用证书身份
+func ownerID(identity string, claims config.KeyClaims) string {
+	if identity != "" {
+		return identity
+	}
+	return claims.ClientID
+}
+
+// 服务端支持的功能
+func (s *Server) serverCapabilities() []string {
+	cfg := s.config()
+	capabilities := []string{capabilityUDP, capabilityAutoPort, capabilityHeartbeat, capabilityShutdown, capabilityUnregister, capabilityRateLimit, capabilityConnLimit, capabilityIPFilter, capabilityProxyProtocol, capabilityBindAddr, capabilityGroup}
+	if cfg.HTTPPort != 0 {
+		capabilities = append(capabilities, capabilityHTTP)
+	}
+	if cfg.HTTPSPort != 0 {
+		capabilities = append(capabilities, capabilityHTTPS)
+	}
+	return capabilities
+}
+
+// 处理桥接连接，区分多路复用会话与旧版单连接
+func (s *Server) handleBridgeConn(conn net.Conn) {
+	// TLS握手及接收第一条协议消息须在心跳超时时间内完成，避免未认证的连接一直占用
+	_ = conn.SetDeadline(time.Now().Add(s.config().Heartbeat.Timeout))
+
+	// 客户端证书身份
+	identity, err := peerIdentity(conn)
+	if err != nil {
+		log.Println("TLS握手失败！", err)
+		closeWithoutError(conn)
+		return
+	}
+
+	bufConn := newBufferedConn(conn)
+	first, err := bufConn.reader.Peek(1)
+	if err != nil {
+		log.Println("接受协议数据失败！", err)
+		closeWithoutError(conn)
+		return
+	}
+
+	if first[0] != muxProtocolVersion {
+		// 旧版客户端，每条连接单独握手
+		protocol := receiveProtocol(bufConn)
+		_ = conn.SetDeadline(time.Time{})
+		s.serveClientConn(bufConn, protocol, identity, nil)
+		return
+	}
+
+	// 多路复用会话，每个数据流都是一条客户端连接
+	session, err := yamux.Server(bufConn, muxConfig(s.config().Heartbeat))
+	if err != nil {
+		log.Println("建立多路复用会话失败！", err)
+		closeWithoutError(conn)
+		return
+	}
+	client := &clientSession{
+		id:          atomic.AddUint64(&s.lastSessionID, 1),
+		identity:    identity,
+		session:     session,
+		connectedAt: time.Now(),
+	}
+	s.sessions.Store(client, struct{}{})
+	defer func() {
+		s.sessions.Delete(client)
+		client.close()
+	}()
+	// 服务端已停止
+	if s.draining() || s.stopped() {
+		return
+	}
+
+	// 第一条数据流收到协议消息之后取消桥接连接的超时，之后由心跳检测
+	stream, err := session.Accept()
+	if err != nil {
+		return
+	}
+	protocol := receiveProtocol(stream)
+	_ = conn.SetDeadline(time.Time{})
+	go s.serveClientConn(stream, protocol, identity, client)
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleClientConn(stream, identity, client)
 	}
-	return protocolResultSuccess
 }
 
-// 处理客户端请求
-func handleClientConn(conn net.Conn, cfg config.ServerConfig, clientTunnelChan chan ClientTunnel) {
-	// 接收客户端发送的协议消息
+// 处理会话中的数据流，未在心跳超时时间内发送协议消息的数据流直接断开
+func (s *Server) handleClientConn(conn net.Conn, identity string, session *clientSession) {
+	_ = conn.SetDeadline(time.Now().Add(s.config().Heartbeat.Timeout))
 	protocol := receiveProtocol(conn)
+	_ = conn.SetDeadline(time.Time{})
+	s.serveClientConn(conn, protocol, identity, session)
+}
+
+// 处理客户端请求，session 为空时为旧版客户端的单独连接
+func (s *Server) serveClientConn(conn net.Conn, protocol Protocol, identity string, session *clientSession) {
+	// 会话已在控制连接上认证，工作连接随会话认证，不再挑战
+	if session != nil && isSessionWorkConn(protocol) && session.authenticated() {
+		protocol.Key = session.key
+		s.handleWorkConn(conn, protocol, session)
+		return
+	}
+	// 未发送密钥的新版客户端使用挑战应答认证
+	if needChallenge(protocol, identity) {
+		protocol = s.challenge(conn, protocol)
+	}
 	// 检查请求合法性
-	if protocolResult := checkProtocol(protocol, cfg); protocolResult != protocolResultSuccess {
+	claims, result := s.checkProtocol(protocol, identity)
+	if result != nil {
 		// 协议不合法，发送失败信息，不在处理
-		sendProtocol(conn, protocol.NewResult(protocolResult))
+		s.sendResult(conn, *result)
 		closeWithoutError(conn)
 		return
 	}
+	// 会话只保存密钥的公开部分，旧版客户端原样返回密钥
+	if !protocol.legacy {
+		protocol.Key = config.KeyToken(protocol.Key)
+	}
+
+	// 新版协议第一个字节为0，与多路复用会话相同，因此没有会话的连接只会是旧版客户端
+	switch {
+	case protocol.legacy:
+		s.handleLegacyConn(conn, protocol, identity)
+	case protocol.Port == 0:
+		s.handleControlConn(conn, protocol, claims, session)
+	default:
+		s.handleWorkConn(conn, protocol, session)
+	}
+}
+
+// 发送握手结果，并记录到监控指标
+func (s *Server) sendResult(conn net.Conn, result Protocol) bool {
+	s.metrics.handshake(result.Result)
+	return sendProtocol(conn, result)
+}
 
-	// 发送认证成功信息
-	if !sendProtocol(conn, protocol.NewResult(protocolResultSuccess)) {
+// 发送认证成功信息
+func (s *Server) sendSuccess(conn net.Conn, protocol Protocol) bool {
+	if !s.sendResult(conn, protocol.NewResult(protocolResultSuccess)) {
 		log.Println("发送认证成功信息失败！", protocol.String())
 		closeWithoutError(conn)
-		return
+		return false
 	}
+	return true
+}
 
+// 处理旧版客户端连接，放入代理端口的会话连接池
+func (s *Server) handleLegacyConn(conn net.Conn, protocol Protocol, identity string) {
+	// 旧版客户端不能加入负载均衡组
+	if _, grouped := s.groups.Load(protocol.Port); grouped {
+		log.Printf("访问端口已被占用：[%d]\n", protocol.Port)
+		s.sendResult(conn, protocol.NewError(protocolResultPortInUse, "访问端口 [%d] 已被其他客户端占用", protocol.Port))
+		closeWithoutError(conn)
+		return
+	}
 	// 建立连接关系，{服务器监听端口 <-> 客户端会话连接池}
-	clientTunnel, exists := clientTunnelMap.Load(protocol.Port)
-	if exists {
-		clientTunnel.(ClientTunnel).connChan <- conn
+	owner := config.ClientLimitIdentity(identity, protocol.Key)
+	value, exists := s.tunnels.Load(protocol.Port)
+	if !exists {
+		// 第一次创建才会执行，避免每次都加锁
+		s.tunnelMutex.Lock()
+		value, exists = s.tunnels.Load(protocol.Port)
+		if !exists {
+			clientTunnel, err := s.newClientTunnel(protocol, config.ProxyTypeTCP, identity, nil, s.config().ProxyBindAddr)
+			if err != nil {
+				log.Printf("监听代理端口失败：[%d]，端口已被占用：[%s]\n", protocol.Port, err.Error())
+				s.tunnelMutex.Unlock()
+				s.sendResult(conn, protocol.NewError(protocolResultPortInUse, "监听访问端口 [%d] 失败", protocol.Port))
+				closeWithoutError(conn)
+				return
+			}
+			clientTunnel.remoteAddr = conn.RemoteAddr()
+			clientTunnel.owner = owner
+			s.tunnels.Store(protocol.Port, clientTunnel)
+			go handleProxyConn(clientTunnel)
+			value = clientTunnel
+		}
+		s.tunnelMutex.Unlock()
+	}
+
+	// 不允许其他客户端向已注册的通道放入连接，避免访问连接被转发到其他客户端
+	clientTunnel := value.(*ClientTunnel)
+	if clientTunnel.session != nil || clientTunnel.owner != owner {
+		log.Printf("访问端口已被占用：[%d]\n", protocol.Port)
+		s.sendResult(conn, protocol.NewError(protocolResultPortInUse, "访问端口 [%d] 已被其他客户端占用", protocol.Port))
+		closeWithoutError(conn)
 		return
 	}
 
-	// 第一次创建才会执行，避免每次都加锁
-	clientTunnelMutex.Lock()
-	defer clientTunnelMutex.Unlock()
+	if !s.sendSuccess(conn, protocol) {
+		return
+	}
 
-	clientTunnel, exists = clientTunnelMap.Load(protocol.Port)
+	defer clientTunnel.stats.trackIdle()()
+	select {
+	case clientTunnel.connChan <- conn:
+	case <-clientTunnel.done:
+		closeWithoutError(conn)
+	}
+}
 
-	if !exists {
-		clientTunnel = ClientTunnel{
-			protocol: protocol,
-			connChan: make(chan net.Conn),
+// 处理控制连接，注册代理端口，连接断开时关闭客户端会话
+func (s *Server) handleControlConn(conn net.Conn, protocol Protocol, claims config.KeyClaims, session *clientSession) {
+	// 协商功能，响应中返回双方都支持的功能
+	control := newControlConn(conn)
+	if !session.setControl(control, protocol.Key, claims, intersectCapabilities(protocol.Capabilities, s.serverCapabilities())) {
+		log.Println("重复的控制连接！", session.String())
+		s.sendResult(conn, protocol.NewError(protocolResultFail, "重复的控制连接"))
+		closeWithoutError(conn)
+		return
+	}
+	// 检查密钥之后、设置控制连接之前吊销的密钥，closeRevoked 无法断开，设置之后再次检查
+	if session.identity == "" && s.keyRevoked(claims) {
+		log.Printf("密钥已吊销，断开客户端：[%s]\n", session.String())
+		s.sendResult(conn, protocol.NewError(protocolResultFailToAuth, "密钥已吊销"))
+		session.close()
+		return
+	}
+
+	result := protocol.NewResult(protocolResultSuccess)
+	result.Capabilities = session.capabilities
+	if !s.sendResult(conn, result) {
+		log.Println("发送认证成功信息失败！", protocol.String())
+		closeWithoutError(conn)
+		session.close()
+		return
+	}
+
+	log.Printf("客户端已连接：[%s]，协议版本：[%d]，功能：%v\n", session.String(), protocol.Version, session.capabilities)
+	// 客户端按心跳间隔发送心跳，超时未收到则断开会话
+	if hasCapability(session.capabilities, capabilityHeartbeat) {
+		control.timeout = s.config().Heartbeat.Timeout
+	}
+	defer session.close()
+
+	for {
+		message, ok := control.receiveMessage()
+		if !ok {
+			log.Printf("客户端已断开：[%s]\n", session.String())
+			return
 		}
-		clientTunnelMap.Store(protocol.Port, clientTunnel)
-		clientTunnelChan <- clientTunnel.(ClientTunnel)
+
+		switch message.Type {
+		case messageRegister:
+			result, port := s.registerTunnel(protocol, message, session)
+			control.sendMessage(Message{Type: messageRegisterResult, Result: result, Name: message.Name, Port: port})
+		case messageUnregister:
+			if session.removeTunnel(message.Port) {
+				log.Printf("客户端已取消注册代理：[%s]，客户端：[%s]\n", message.Name, session.String())
+			}
+		case messagePing:
+			control.sendMessage(Message{Type: messagePong})
+		default:
+			log.Println("未知的控制消息！", message.Type)
+		}
+	}
+}
+
+// 注册代理，返回结果及访问端口
+func (s *Server) registerTunnel(protocol Protocol, message Message, session *clientSession) (byte, uint32) {
+	if s.draining() {
+		log.Printf("服务端正在停止，拒绝注册代理，客户端：[%s]\n", session.String())
+		return protocolResultFail, message.Port
 	}
 
-	clientTunnel.(ClientTunnel).connChan <- conn
+	proxyType := message.ProxyType
+	if proxyType == "" {
+		proxyType = config.ProxyTypeTCP
+	}
+
+	// 未协商的功能不可使用
+	capabilities := requiredCapabilities(proxyType, message.Port)
+	if message.Group != "" {
+		capabilities = append(capabilities, capabilityGroup)
+	}
+	for _, capability := range capabilities {
+		if !hasCapability(session.capabilities, capability) {
+			log.Printf("未协商的功能：[%s]，客户端：[%s]\n", capability, session.String())
+			return protocolResultFail, message.Port
+		}
+	}
+
+	// 密钥声明限制的代理类型及访问端口，自动分配时只在允许的范围内分配
+	if !session.claims.AllowProxyType(proxyType) {
+		log.Printf("密钥不允许使用该代理类型：[%s]，客户端：[%s]\n", proxyType, session.String())
+		return protocolResultFail, message.Port
+	}
+	if message.Port != 0 && !session.claims.AllowPort(message.Port) {
+		log.Printf("密钥不允许使用该访问端口：[%d]，客户端：[%s]\n", message.Port, session.String())
+		return protocolResultIllegalAccessPort, message.Port
+	}
+	// 客户端凭据配置的访问端口及域名归该客户端所有
+	// 加入负载均衡组时，凭据中都配置了该端口的客户端可以共享
+	group, err := message.proxyGroup()
+	if err != nil {
+		log.Printf("%s，客户端：[%s]\n", err.Error(), session.String())
+		return protocolResultFail, message.Port
+	}
+	if group.Enabled() && (proxyType != config.ProxyTypeTCP || message.Port == 0) {
+		log.Printf("负载均衡组只支持指定访问端口的 tcp 代理，客户端：[%s]\n", session.String())
+		return protocolResultFail, message.Port
+	}
+	cfg := s.config()
+	reserved := cfg.PortReserved
+	if group.Enabled() {
+		reserved = cfg.GroupPortReserved
+	}
+	if message.Port != 0 && reserved(message.Port, session.ownerID()) {
+		log.Printf("访问端口归其他客户端所有：[%d]，客户端：[%s]\n", message.Port, session.String())
+		return protocolResultIllegalAccessPort, message.Port
+	}
+	if proxyType == config.ProxyTypeHTTP || proxyType == config.ProxyTypeHTTPS {
+		for _, domain := range message.Domains {
+			if !session.claims.AllowDomain(domain) {
+				log.Printf("密钥不允许使用该访问域名：[%s]，客户端：[%s]\n", domain, session.String())
+				return protocolResultFail, message.Port
+			}
+			if cfg.DomainReserved(domain, session.ownerID()) {
+				log.Printf("访问域名归其他客户端所有：[%s]，客户端：[%s]\n", domain, session.String())
+				return protocolResultDomainInUse, message.Port
+			}
+		}
+	}
+
+	if _, err := config.ParseIPFilter(message.Allow, message.Deny); err != nil {
+		log.Printf("访问地址过滤格式不对：[%s]，客户端：[%s]\n", err.Error(), session.String())
+		return protocolResultFail, message.Port
+	}
+
+	switch message.ProxyProtocol {
+	case "":
+	case config.ProxyProtocolV1, config.ProxyProtocolV2:
+		if proxyType == config.ProxyTypeUDP {
+			log.Printf("UDP代理不支持 PROXY protocol，客户端：[%s]\n", session.String())
+			return protocolResultFail, message.Port
+		}
+	default:
+		log.Printf("PROXY protocol 版本不支持：[%s]，客户端：[%s]\n", message.ProxyProtocol, session.String())
+		return protocolResultFail, message.Port
+	}
+
+	switch proxyType {
+	case config.ProxyTypeTCP, config.ProxyTypeUDP:
+		return s.registerPortTunnel(protocol, message, proxyType, session)
+	case config.ProxyTypeHTTP, config.ProxyTypeHTTPS:
+		return s.registerDomainTunnel(protocol, message, proxyType, session)
+	default:
+		log.Printf("代理类型不支持：[%s]，客户端：[%s]\n", proxyType, session.String())
+		return protocolResultFail, message.Port
+	}
 }
 
-// 处理端口转发，转发访问数据
-func handleProxyConn(clientTunnel ClientTunnel) {
-	// 代理端口号
-	listenPort := clientTunnel.protocol.Port
-	// 监听服务端代理端口
-	listener, err := listen(listenPort)
+// 注册端口代理，返回结果及访问端口，访问端口为0时由服务端分配
+func (s *Server) registerPortTunnel(protocol Protocol, message Message, proxyType string, session *clientSession) (byte, uint32) {
+	port := message.Port
+	cfg := s.config()
+	if port != 0 && !cfg.PortInRange(port) {
+		log.Printf("访问端口不合法：[%d]，客户端：[%s]\n", port, session.String())
+		return protocolResultIllegalAccessPort, port
+	}
+
+	// 监听地址，服务端已指定时客户端不能修改
+	bindAddr, err := config.ParseBindAddr(message.BindAddr)
 	if err != nil {
-		log.Printf("监听代理端口失败：[%d]，端口已被占用：[%s]\n", listenPort, err.Error())
-		// 关闭连接
-		closeWithoutError(<-clientTunnel.connChan)
-		// 清除Map
-		clientTunnelMap.Delete(listenPort)
+		log.Printf("%s，客户端：[%s]\n", err.Error(), session.String())
+		return protocolResultFail, port
+	}
+	if bindAddr == "" {
+		bindAddr = cfg.ProxyBindAddr
+	} else if cfg.ProxyBindAddr != "" && bindAddr != cfg.ProxyBindAddr {
+		log.Printf("监听地址不允许：[%s]，服务端只监听：[%s]，客户端：[%s]\n", bindAddr, cfg.ProxyBindAddr, session.String())
+		return protocolResultFail, port
+	}
+
+	s.tunnelMutex.Lock()
+	defer s.tunnelMutex.Unlock()
+
+	// 注册时已检查格式
+	if group, _ := message.proxyGroup(); group.Enabled() {
+		return s.joinGroup(protocol, message, group, session, bindAddr)
+	}
+
+	var clientTunnel *ClientTunnel
+	if port == 0 {
+		if clientTunnel = s.assignPortTunnel(protocol, proxyType, session, bindAddr); clientTunnel == nil {
+			log.Printf("没有可分配的访问端口，客户端：[%s]\n", session.String())
+			return protocolResultIllegalAccessPort, port
+		}
+		port = clientTunnel.protocol.Port
+		log.Printf("已分配访问端口：[%s/%d]，客户端：[%s]\n", proxyType, port, session.String())
+	} else {
+		if s.portInUse(port) {
+			log.Printf("访问端口已被占用：[%d]，客户端：[%s]\n", port, session.String())
+			return protocolResultPortInUse, port
+		}
+
+		protocol.Port = port
+		if clientTunnel, err = s.newClientTunnel(protocol, proxyType, session.identity, session, bindAddr); err != nil {
+			log.Printf("监听代理端口失败：[%s/%d]，端口已被占用：[%s]\n", proxyType, port, err.Error())
+			return protocolResultPortInUse, port
+		}
+	}
+
+	clientTunnel.setMapping(message)
+	// 先保存再加入会话，会话同时关闭时由通道关闭移除，避免残留已关闭的通道
+	s.tunnels.Store(port, clientTunnel)
+	if !session.addTunnel(clientTunnel) {
+		clientTunnel.close()
+		return protocolResultFail, port
+	}
+	if proxyType == config.ProxyTypeUDP {
+		go handleUDPProxy(clientTunnel)
+	} else {
+		go handleProxyConn(clientTunnel)
+	}
+
+	return protocolResultSuccess, port
+}
+
+// 在允许范围内分配一个空闲的访问端口并创建通道，需持有 s.tunnelMutex
+func (s *Server) assignPortTunnel(protocol Protocol, proxyType string, session *clientSession, bindAddr string) *ClientTunnel {
+	// 范围不含边界
+	cfg := s.config()
+	if cfg.MaxProxyPort <= cfg.MinProxyPort+1 {
+		return nil
+	}
+	count := cfg.MaxProxyPort - cfg.MinProxyPort - 1
+	for i := uint32(1); i <= count; i++ {
+		port := cfg.MinProxyPort + 1 + (s.lastAssignedPort+i)%count
+		if s.portInUse(port) || !session.claims.AllowPort(port) || cfg.PortReserved(port, session.ownerID()) {
+			continue
+		}
+		protocol.Port = port
+		if clientTunnel, err := s.newClientTunnel(protocol, proxyType, session.identity, session, bindAddr); err == nil {
+			s.lastAssignedPort = port - cfg.MinProxyPort - 1
+			return clientTunnel
+		}
+	}
+	return nil
+}
+
+// 注册域名代理，返回结果及分配的虚拟端口
+func (s *Server) registerDomainTunnel(protocol Protocol, message Message, proxyType string, session *clientSession) (byte, uint32) {
+	domains := message.Domains
+	cfg := s.config()
+	if (proxyType == config.ProxyTypeHTTP && cfg.HTTPPort == 0) ||
+		(proxyType == config.ProxyTypeHTTPS && cfg.HTTPSPort == 0) {
+		log.Printf("服务端未启用域名代理：[%s]，客户端：[%s]\n", proxyType, session.String())
+		return protocolResultFail, 0
+	}
+	if len(domains) == 0 {
+		log.Printf("域名代理缺少访问域名，客户端：[%s]\n", session.String())
+		return protocolResultFail, 0
+	}
+
+	s.tunnelMutex.Lock()
+	defer s.tunnelMutex.Unlock()
+
+	for _, domain := range domains {
+		if _, exists := s.domainMap(proxyType).Load(domain); exists {
+			log.Printf("访问域名已被占用：[%s]，客户端：[%s]\n", domain, session.String())
+			return protocolResultDomainInUse, 0
+		}
+	}
+
+	protocol.Port = s.nextVirtualPort()
+	clientTunnel := s.newTunnel(protocol, proxyType, session.identity, session, "")
+	clientTunnel.setMapping(message)
+	clientTunnel.domains = domains
+	// 先保存再加入会话，会话同时关闭时由通道关闭移除，避免域名指向已关闭的通道
+	s.tunnels.Store(protocol.Port, clientTunnel)
+	for _, domain := range domains {
+		s.domainMap(proxyType).Store(domain, clientTunnel)
+	}
+	if !session.addTunnel(clientTunnel) {
+		clientTunnel.close()
+		return protocolResultFail, 0
+	}
+	log.Printf("已注册域名代理：[%s] %v\n", proxyType, domains)
+
+	return protocolResultSuccess, protocol.Port
+}
+
+// 处理工作连接，交给等待中的访问连接
+func (s *Server) handleWorkConn(conn net.Conn, protocol Protocol, session *clientSession) {
+	value, exists := s.tunnels.Load(protocol.Port)
+	if !exists || value.(*ClientTunnel).session != session {
+		log.Println("访问端口未注册！", protocol.String())
+		s.sendResult(conn, protocol.NewError(protocolResultIllegalAccessPort, "访问端口 [%d] 未注册", protocol.Port))
+		closeWithoutError(conn)
+		return
+	}
+
+	if !s.sendSuccess(conn, protocol) {
 		return
 	}
+
+	clientTunnel := value.(*ClientTunnel)
+	defer clientTunnel.stats.trackIdle()()
+	select {
+	case clientTunnel.connChan <- conn:
+	case <-time.After(workConnTimeout):
+		// 访问连接已超时离开
+		closeWithoutError(conn)
+	case <-clientTunnel.done:
+		closeWithoutError(conn)
+	}
+}
+
+// 处理端口转发，转发访问数据
+func handleProxyConn(clientTunnel *ClientTunnel) {
+	// 代理端口号
+	listenPort := clientTunnel.protocol.Port
 	log.Printf("正在监听指定代理端口：[%d]\n", listenPort)
 
 	for {
-		proxyConn, err := listener.Accept()
+		proxyConn, err := clientTunnel.listener.Accept()
 		if err != nil {
+			if clientTunnel.closed() || clientTunnel.server.draining() {
+				return
+			}
 			log.Println("接受代理端口连接失败！", err)
+			continue
+		}
+		if !clientTunnel.allow(proxyConn.RemoteAddr()) {
 			closeWithoutError(proxyConn)
 			continue
 		}
 
-		for clientConn := range clientTunnel.connChan {
-			// 进行数据转发
-			go forward(proxyConn, clientConn)
+		go handleVisitorConn(clientTunnel, proxyConn)
+	}
+}
+
+// 取得一条客户端连接，超时或者通道关闭时返回空
+func (t *ClientTunnel) getWorkConn() net.Conn {
+	// 通知客户端建立工作连接
+	if t.session != nil {
+		message := Message{Type: messageNewConn, Port: t.protocol.Port}
+		if !t.session.control.sendMessage(message) {
+			return nil
 		}
 	}
+
+	select {
+	case clientConn := <-t.connChan:
+		return clientConn
+	case <-time.After(workConnTimeout):
+		log.Printf("等待客户端连接超时，代理端口：[%d]\n", t.protocol.Port)
+		return nil
+	case <-t.done:
+		return nil
+	}
 }
 
-// 入口
-func Server(cfg config.ServerConfig) {
+// 取得访问连接对应的客户端连接，需要 PROXY protocol 时先发送访问者信息，失败时返回空
+func (t *ClientTunnel) connectVisitor(visitorConn net.Conn) net.Conn {
+	clientConn := t.getWorkConn()
+	if clientConn == nil || t.proxyProtocol == "" {
+		return clientConn
+	}
+	if !sendVisitorInfo(clientConn, visitorConn) {
+		return nil
+	}
+	return clientConn
+}
+
+// 处理访问连接，准入之后取得一条客户端连接进行数据转发
+func handleVisitorConn(clientTunnel *ClientTunnel, proxyConn net.Conn) {
+	defer clientTunnel.server.trackConn()()
+
+	if !clientTunnel.serveVisitor(proxyConn) {
+		closeWithoutError(proxyConn)
+	}
+}
+
+// 准入之后取得一条客户端连接进行数据转发，未准入或者未取得客户端连接时返回 false，由调用方关闭访问连接
+func (t *ClientTunnel) serveVisitor(proxyConn net.Conn) bool {
+	release, ok := t.admit()
+	if !ok {
+		return false
+	}
+	defer release()
+
+	clientConn := t.connectVisitor(proxyConn)
+	if clientConn == nil {
+		return false
+	}
+	t.forward(proxyConn, clientConn)
+	return true
+}
+
+// 访问端口是否已被代理通道或者负载均衡组占用
+func (s *Server) portInUse(port uint32) bool {
+	if _, exists := s.tunnels.Load(port); exists {
+		return true
+	}
+	_, exists := s.groups.Load(port)
+	return exists
+}
+
+// 启动服务端，监听桥接端口及域名代理共享端口，监听失败时返回错误
+// ctx 取消时停止服务端
+func (s *Server) Start(ctx context.Context) error {
+	cfg := s.config()
 	log.Println("加载服务端配置：", cfg)
 
-	// 服务器监听端口 <-> 客户端会话池
-	clientTunnelChan := make(chan ClientTunnel)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.started {
+		return errors.New("服务端已启动")
+	}
+	if err := cfg.Heartbeat.Check(); err != nil {
+		return fmt.Errorf("心跳配置错误：%w", err)
+	}
+	if err := s.loadRevocations(); err != nil {
+		return fmt.Errorf("加载密钥吊销列表失败：%w", err)
+	}
+
+	// 桥接端口TLS配置
+	if cfg.TLS.ServerEnabled() {
+		var err error
+		if s.tlsConfig, err = cfg.TLS.ServerTLSConfig(); err != nil {
+			return fmt.Errorf("加载TLS证书失败：%w", err)
+		}
+		log.Println("桥接端口已启用TLS加密")
+	}
+
+	// 监听桥接端口
+	listener, err := listenTLS(cfg.BindAddr, cfg.Port, s.tlsConfig, cfg.Heartbeat.TCPKeepAlive)
+	if err != nil {
+		return fmt.Errorf("监听端口失败：[%d]，%w", cfg.Port, err)
+	}
+	s.listeners = append(s.listeners, listener)
 
-	// 受理来自客户端连接请求
-	go func(cfg config.ServerConfig, clientTunnelChan chan ClientTunnel) {
-		// 监听桥接端口
-		listener, err := listen(cfg.Port)
+	// 域名代理共享端口，全部监听成功之后再开始受理连接
+	vhosts := map[string]uint32{config.ProxyTypeHTTP: cfg.HTTPPort, config.ProxyTypeHTTPS: cfg.HTTPSPort}
+	vhostListeners := make(map[string]net.Listener)
+	for proxyType, port := range vhosts {
+		if port == 0 {
+			continue
+		}
+		vhostListener, err := listen(cfg.ProxyBindAddr, port)
 		if err != nil {
-			log.Fatalf("监听端口失败：[%d]，端口已被占用：[%s]\n", cfg.Port, err.Error())
+			closeWithoutError(s.listeners...)
+			s.listeners = nil
+			return fmt.Errorf("监听%s端口失败：[%d]，%w", strings.ToUpper(proxyType), port, err)
 		}
+		s.listeners = append(s.listeners, vhostListener)
+		vhostListeners[proxyType] = vhostListener
+	}
 
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Println("接受客户端会话失败！", err)
-				continue
+	// 管理接口及监控指标端口，优雅停止期间仍可访问
+	var adminListener, metricsListener net.Listener
+	if cfg.AdminAddr != "" {
+		if adminListener, err = s.listenAdmin(cfg.AdminAddr); err != nil {
+			closeWithoutError(s.listeners...)
+			s.listeners = nil
+			return fmt.Errorf("监听管理接口失败：[%s]，%w", cfg.AdminAddr, err)
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		if s.metricsServer, metricsListener, err = listenMetrics(cfg.MetricsAddr, func() string { return s.config().MetricsToken }, s.writeMetrics); err != nil {
+			closeWithoutError(s.listeners...)
+			closeWithoutError(adminListener)
+			s.listeners = nil
+			return fmt.Errorf("监听监控指标端口失败：[%s]，%w", cfg.MetricsAddr, err)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			serveMetrics(s.metricsServer, metricsListener)
+		}()
+	}
+	if adminListener != nil {
+		s.wg.Add(1)
+		go s.serveAdmin(adminListener)
+	}
+
+	for proxyType, vhostListener := range vhostListeners {
+		s.wg.Add(1)
+		go s.serveVhost(proxyType, vhosts[proxyType], vhostListener)
+	}
+
+	if cfg.RevocationFile != "" {
+		s.wg.Add(1)
+		go s.watchRevocations(cfg.RevocationFile)
+	}
+
+	s.started = true
+	s.wg.Add(1)
+	go s.serveBridge(listener)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// 受理来自客户端连接请求
+func (s *Server) serveBridge(listener net.Listener) {
+	defer s.wg.Done()
+	log.Printf("正在监听桥接端口：[%d]\n", s.config().Port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.draining() || s.stopped() {
+				return
 			}
-			go handleClientConn(conn, cfg, clientTunnelChan)
+			log.Println("接受客户端会话失败！", err)
+			continue
 		}
-	}(cfg, clientTunnelChan)
+		go s.handleBridgeConn(conn)
+	}
+}
 
-	// 处理代理连接，转发访问数据
-	for clientTunnel := range clientTunnelChan {
-		go handleProxyConn(clientTunnel)
+// 立即停止服务端，关闭所有监听端口、客户端会话及代理通道，进行中的连接随之断开，优雅停止使用 Shutdown
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		// Wait 等待关闭完成
+		s.wg.Add(1)
+		defer s.wg.Done()
+		close(s.done)
+
+		s.mutex.Lock()
+		closeWithoutError(s.listeners...)
+		if s.admin != nil {
+			closeWithoutError(s.admin)
+		}
+		if s.metricsServer != nil {
+			closeWithoutError(s.metricsServer)
+		}
+		s.mutex.Unlock()
+
+		s.sessions.Range(func(key, value interface{}) bool {
+			key.(*clientSession).close()
+			return true
+		})
+		// 旧版客户端的代理通道不属于任何会话
+		s.tunnels.Range(func(key, value interface{}) bool {
+			value.(*ClientTunnel).close()
+			return true
+		})
+		log.Println("服务端已停止")
+	})
+}
+
+// 等待服务端停止，未启动或者启动失败时立即返回
+func (s *Server) Wait() error {
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	if !started {
+		return nil
+	}
+
+	<-s.done
+	s.wg.Wait()
+	return nil
+}
+
+// 服务端是否已停止
+func (s *Server) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
 	}
 }
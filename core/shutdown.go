@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 等待进行中的连接完成时的检查间隔
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+// 记录进行中的访问连接，返回连接结束时调用的函数
+func (s *Server) trackConn() func() {
+	atomic.AddInt64(&s.activeConns, 1)
+	return func() {
+		atomic.AddInt64(&s.activeConns, -1)
+	}
+}
+
+// 进行中的访问连接数
+func (s *Server) ActiveConns() int64 {
+	return atomic.LoadInt64(&s.activeConns)
+}
+
+// 是否正在停止，停止过程中不再受理新的客户端及访问连接
+func (s *Server) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// 优雅停止服务端
+// 停止受理新的客户端及访问连接，通知已连接的客户端，等待进行中的连接完成之后停止
+// 最多等待配置的 DrainTimeout，ctx 提前结束时不再等待，强制停止并返回错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config().DrainTimeout)
+	defer cancel()
+
+	s.drainOnce.Do(func() {
+		close(s.drain)
+		log.Printf("服务端正在停止，等待进行中的连接完成：[%d]\n", s.ActiveConns())
+
+		// 停止监听桥接端口、域名代理共享端口及代理端口，UDP代理端口不再创建新的访问会话
+		s.mutex.Lock()
+		closeWithoutError(s.listeners...)
+		s.mutex.Unlock()
+		s.tunnels.Range(func(key, value interface{}) bool {
+			closeWithoutError(value.(*ClientTunnel).listener)
+			return true
+		})
+		s.groups.Range(func(key, value interface{}) bool {
+			closeWithoutError(value.(*tunnelGroup).listener)
+			return true
+		})
+
+		// 通知客户端，客户端不再等待本服务端恢复
+		s.sessions.Range(func(key, value interface{}) bool {
+			key.(*clientSession).notifyShutdown()
+			return true
+		})
+	})
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	var err error
+	for s.ActiveConns() > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Printf("等待连接完成超时，强制停止：[%d]\n", s.ActiveConns())
+		case <-s.done:
+			// 已被强制停止
+			return nil
+		}
+	}
+
+	s.Stop()
+	return err
+}
+
+// 通知客户端服务端即将停止
+func (s *clientSession) notifyShutdown() {
+	s.mutex.Lock()
+	control := s.control
+	s.mutex.Unlock()
+
+	if control != nil && hasCapability(s.capabilities, capabilityShutdown) {
+		control.sendMessage(Message{Type: messageShutdown})
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// 代理通道访问统计，均使用原子操作读写
+type tunnelStats struct {
+	activeConns int64 // 进行中的访问连接数
+	idleConns   int64 // 等待访问的客户端连接数
+	bytesIn     int64 // 访问者发送给客户端的字节数
+	bytesOut    int64 // 客户端返回给访问者的字节数
+
+	rejectedConns int64 // 超出连接数限制被拒绝的访问连接数
+	deniedConns   int64 // 访问地址不允许被拒绝的访问连接数
+}
+
+// 记录进行中的访问连接，返回连接结束时调用的函数
+func (s *tunnelStats) trackConn() func() {
+	atomic.AddInt64(&s.activeConns, 1)
+	return func() {
+		atomic.AddInt64(&s.activeConns, -1)
+	}
+}
+
+// 记录等待访问的客户端连接，返回连接被取走或者放弃时调用的函数
+func (s *tunnelStats) trackIdle() func() {
+	atomic.AddInt64(&s.idleConns, 1)
+	return func() {
+		atomic.AddInt64(&s.idleConns, -1)
+	}
+}
+
+// 记录转发的字节数
+func (s *tunnelStats) addBytes(in, out int) {
+	if in > 0 {
+		atomic.AddInt64(&s.bytesIn, int64(in))
+	}
+	if out > 0 {
+		atomic.AddInt64(&s.bytesOut, int64(out))
+	}
+}
+
+// 累加其他通道的统计，用于按共享的访问端口合计
+func (s *tunnelStats) add(other *tunnelStats) {
+	s.activeConns += atomic.LoadInt64(&other.activeConns)
+	s.idleConns += atomic.LoadInt64(&other.idleConns)
+	s.bytesIn += atomic.LoadInt64(&other.bytesIn)
+	s.bytesOut += atomic.LoadInt64(&other.bytesOut)
+	s.rejectedConns += atomic.LoadInt64(&other.rejectedConns)
+	s.deniedConns += atomic.LoadInt64(&other.deniedConns)
+}
+
+// 转发访问连接与客户端连接之间的数据，记录访问统计并按限速转发
+func (t *ClientTunnel) forward(visitorConn net.Conn, clientConn net.Conn) {
+	defer t.stats.trackConn()()
+	in, out := newFlows(t.trafficStats(), t.bandwidths)
+	forward(visitorConn, clientConn, in, out)
+}
+
+// 记录转发字节数的访问统计，未启用管理接口及监控指标时返回空，不记录字节数
+func (t *ClientTunnel) trafficStats() *tunnelStats {
+	if cfg := t.server.config(); cfg.AdminAddr == "" && cfg.MetricsAddr == "" {
+		return nil
+	}
+	return &t.stats
+}
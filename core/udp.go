@@ -0,0 +1,215 @@
+package core
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// UDP访问会话空闲超时时间
+	udpSessionTimeout = 60 * time.Second
+	// UDP数据包最大长度
+	maxUDPPacketSize = 65535
+	// 每个会话待发送的数据包队列长度，队列满时丢弃
+	udpPacketQueueSize = 128
+)
+
+// UDP数据包格式
+// 数据包长度(2字节)|数据包
+
+// 写入一个数据包
+func writeUDPPacket(w io.Writer, packet []byte) error {
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 读取一个数据包
+func readUDPPacket(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	return io.ReadFull(r, buf[:length])
+}
+
+// UDP访问会话，每个访问地址对应一条工作连接
+type udpSession struct {
+	addr       net.Addr      // 访问地址
+	packetChan chan []byte   // 待发送到客户端的数据包
+	lastActive int64         // 最后活跃时间
+	done       chan struct{} // 会话关闭通知
+}
+
+// 更新活跃时间
+func (s *udpSession) active() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// 是否已空闲超时
+func (s *udpSession) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) > udpSessionTimeout
+}
+
+// 处理UDP代理端口，按访问地址建立会话，通过工作连接转发数据包
+func handleUDPProxy(clientTunnel *ClientTunnel) {
+	listenPort := clientTunnel.protocol.Port
+	log.Printf("正在监听指定UDP代理端口：[%d]\n", listenPort)
+
+	var mutex sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, addr, err := clientTunnel.packetConn.ReadFrom(buf)
+		if err != nil {
+			if clientTunnel.closed() {
+				return
+			}
+			log.Println("接受UDP代理端口数据失败！", err)
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		mutex.Lock()
+		session, exists := sessions[addr.String()]
+		if !exists && clientTunnel.server.draining() {
+			// 服务端正在停止，不再创建新的访问会话
+			mutex.Unlock()
+			continue
+		}
+		if !exists && !clientTunnel.allow(addr) {
+			mutex.Unlock()
+			continue
+		}
+		if !exists {
+			session = &udpSession{
+				addr:       addr,
+				packetChan: make(chan []byte, udpPacketQueueSize),
+				done:       make(chan struct{}),
+			}
+			session.active()
+			sessions[addr.String()] = session
+
+			go func() {
+				serveUDPSession(clientTunnel, session)
+				mutex.Lock()
+				delete(sessions, session.addr.String())
+				mutex.Unlock()
+			}()
+		}
+		mutex.Unlock()
+
+		select {
+		case session.packetChan <- packet:
+		default:
+			// 队列已满，丢弃数据包
+		}
+	}
+}
+
+// 处理单个UDP访问会话，空闲超时或者连接断开时返回
+func serveUDPSession(clientTunnel *ClientTunnel, session *udpSession) {
+	defer clientTunnel.server.trackConn()()
+
+	// 每个访问会话占用一个连接数
+	release, ok := clientTunnel.admit()
+	if !ok {
+		return
+	}
+	defer release()
+
+	clientConn := clientTunnel.getWorkConn()
+	if clientConn == nil {
+		return
+	}
+	defer closeWithoutError(clientConn)
+	defer clientTunnel.stats.trackConn()()
+	in, out := newFlows(clientTunnel.trafficStats(), clientTunnel.bandwidths)
+
+	// 客户端返回的数据包发送给访问地址
+	go func() {
+		defer close(session.done)
+
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := readUDPPacket(clientConn, buf)
+			if err != nil {
+				return
+			}
+			session.active()
+			out.wait(n)
+			out.add(n)
+			if _, err := clientTunnel.packetConn.WriteTo(buf[:n], session.addr); err != nil {
+				log.Println("发送UDP数据失败！", err)
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(udpSessionTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet := <-session.packetChan:
+			session.active()
+			in.wait(len(packet))
+			if err := writeUDPPacket(clientConn, packet); err != nil {
+				return
+			}
+			in.add(len(packet))
+		case <-ticker.C:
+			if session.idle() {
+				return
+			}
+		case <-session.done:
+			return
+		case <-clientTunnel.done:
+			return
+		}
+	}
+}
+
+// 客户端转发UDP数据包，工作连接与本地服务之间双向转发，in、out 记录两个方向转发的字节数
+func forwardUDP(serverConn net.Conn, localConn net.Conn, in *flow, out *flow) {
+	defer closeWithoutError(serverConn, localConn)
+
+	// 本地服务返回的数据包发送给服务端
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := localConn.Read(buf)
+			if err != nil {
+				closeWithoutError(serverConn)
+				return
+			}
+			if err := writeUDPPacket(serverConn, buf[:n]); err != nil {
+				return
+			}
+			out.add(n)
+		}
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, err := readUDPPacket(serverConn, buf)
+		if err != nil {
+			return
+		}
+		if _, err := localConn.Write(buf[:n]); err != nil {
+			log.Println("发送UDP数据到本地服务失败！", err)
+			continue
+		}
+		in.add(n)
+	}
+}
@@ -0,0 +1,278 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/aulang/netbus/config"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 读取请求头的超时时间
+	vhostReadTimeout = 10 * time.Second
+)
+
+// 代理类型对应的域名表
+func (s *Server) domainMap(proxyType string) *sync.Map {
+	if proxyType == config.ProxyTypeHTTPS {
+		return &s.httpsDomains
+	}
+	return &s.httpDomains
+}
+
+// 查找域名对应的通道，支持泛域名，如 *.aulang.cn
+func (s *Server) lookupDomain(proxyType string, host string) *ClientTunnel {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domains := s.domainMap(proxyType)
+
+	if value, exists := domains.Load(host); exists {
+		return value.(*ClientTunnel)
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		if value, exists := domains.Load("*" + host[i:]); exists {
+			return value.(*ClientTunnel)
+		}
+	}
+	return nil
+}
+
+// 去掉端口号
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// 受理域名代理共享端口的访问连接
+func (s *Server) serveVhost(proxyType string, port uint32, listener net.Listener) {
+	defer s.wg.Done()
+	name := strings.ToUpper(proxyType)
+	log.Printf("正在监听%s域名代理端口：[%d]\n", name, port)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.draining() || s.stopped() {
+				return
+			}
+			log.Printf("接受%s连接失败！%v\n", name, err)
+			continue
+		}
+		if !s.allowVisitor(port, conn.RemoteAddr()) {
+			closeWithoutError(conn)
+			continue
+		}
+		if proxyType == config.ProxyTypeHTTPS {
+			go s.handleHTTPSConn(conn)
+		} else {
+			go s.handleHTTPConn(conn)
+		}
+	}
+}
+
+// 取得通道的客户端连接，先发送已读取的数据，返回空表示失败
+func openDomainConn(clientTunnel *ClientTunnel, conn net.Conn, head []byte) net.Conn {
+	clientConn := clientTunnel.connectVisitor(conn)
+	if clientConn == nil {
+		return nil
+	}
+	if _, err := clientConn.Write(head); err != nil {
+		closeWithoutError(clientConn)
+		return nil
+	}
+	clientTunnel.stats.addBytes(len(head), 0)
+	return clientConn
+}
+
+// 处理HTTP连接，根据 Host 请求头转发给对应的客户端
+func (s *Server) handleHTTPConn(conn net.Conn) {
+	defer s.trackConn()()
+
+	// 记录已读取的数据，转发时原样发送
+	var head bytes.Buffer
+
+	_ = conn.SetReadDeadline(time.Now().Add(vhostReadTimeout))
+	request, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, &head)))
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		closeWithoutError(conn)
+		return
+	}
+
+	host := hostWithoutPort(request.Host)
+	clientTunnel := s.lookupDomain(config.ProxyTypeHTTP, host)
+	if clientTunnel == nil {
+		log.Printf("访问域名未注册：[%s/%s]\n", config.ProxyTypeHTTP, host)
+		writeHTTPError(conn, http.StatusNotFound)
+		closeWithoutError(conn)
+		return
+	}
+	if !clientTunnel.allow(conn.RemoteAddr()) {
+		writeHTTPError(conn, http.StatusForbidden)
+		closeWithoutError(conn)
+		return
+	}
+
+	release, ok := clientTunnel.admit()
+	if !ok {
+		writeHTTPError(conn, http.StatusServiceUnavailable)
+		closeWithoutError(conn)
+		return
+	}
+	defer release()
+
+	// 长连接只按第一个请求的 Host 转发，之后其他域名的请求会转发给同一客户端，因此每条访问连接只转发一个请求
+	data := head.Bytes()
+	if !isUpgradeRequest(request) {
+		data = closeAfterRequest(data)
+	}
+	clientConn := openDomainConn(clientTunnel, conn, data)
+	if clientConn == nil {
+		writeHTTPError(conn, http.StatusBadGateway)
+		closeWithoutError(conn)
+		return
+	}
+	clientTunnel.forward(conn, clientConn)
+}
+
+// 是否为协议升级请求，如 WebSocket，升级之后的连接不再有其他请求，保持原样转发
+func isUpgradeRequest(request *http.Request) bool {
+	if request.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range request.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 将请求头中的连接选项改为 Connection: close，本地服务响应之后关闭连接，访问者使用新连接发送之后的请求
+// head 为已读取的原始数据，请求头之后已读取的请求体原样保留，找不到请求头结尾时原样返回
+func closeAfterRequest(head []byte) []byte {
+	end := bytes.Index(head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return head
+	}
+	lines := bytes.Split(head[:end], []byte("\r\n"))
+
+	var buf bytes.Buffer
+	buf.Write(lines[0])
+	buf.WriteString("\r\n")
+	for _, line := range lines[1:] {
+		name := line
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			name = line[:i]
+		}
+		switch strings.ToLower(string(bytes.TrimSpace(name))) {
+		case "connection", "keep-alive", "proxy-connection":
+			continue
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("Connection: close\r\n\r\n")
+	buf.Write(head[end+4:])
+	return buf.Bytes()
+}
+
+// 处理HTTPS连接，根据 ClientHello 中的 SNI 转发给对应的客户端，不解密数据
+func (s *Server) handleHTTPSConn(conn net.Conn) {
+	defer s.trackConn()()
+
+	// 记录已读取的数据，转发时原样发送
+	var head bytes.Buffer
+
+	_ = conn.SetReadDeadline(time.Now().Add(vhostReadTimeout))
+	serverName, err := readServerName(io.TeeReader(conn, &head))
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println("读取TLS服务器名称失败！", err)
+		closeWithoutError(conn)
+		return
+	}
+
+	clientTunnel := s.lookupDomain(config.ProxyTypeHTTPS, serverName)
+	if clientTunnel == nil {
+		log.Printf("访问域名未注册：[%s/%s]\n", config.ProxyTypeHTTPS, serverName)
+		closeWithoutError(conn)
+		return
+	}
+	if !clientTunnel.allow(conn.RemoteAddr()) {
+		closeWithoutError(conn)
+		return
+	}
+
+	release, ok := clientTunnel.admit()
+	if !ok {
+		closeWithoutError(conn)
+		return
+	}
+	defer release()
+
+	clientConn := openDomainConn(clientTunnel, conn, head.Bytes())
+	if clientConn == nil {
+		closeWithoutError(conn)
+		return
+	}
+	clientTunnel.forward(conn, clientConn)
+}
+
+// 读取到 ClientHello 之后中止握手
+var errClientHelloRead = errors.New("client hello read")
+
+// 从 ClientHello 中读取 SNI 服务器名称
+func readServerName(reader io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(readOnlyConn{reader: reader}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if serverName == "" {
+		if err == errClientHelloRead {
+			err = errors.New("ClientHello 中没有服务器名称")
+		}
+		return "", err
+	}
+	return serverName, nil
+}
+
+// 只读连接，仅用于解析 ClientHello，不向访问者发送任何数据
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// 返回HTTP错误信息
+func writeHTTPError(conn net.Conn, status int) {
+	text := http.StatusText(status)
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s",
+		status, text, len(text), text)
+}
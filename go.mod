@@ -3,5 +3,6 @@ module github.com/aulang/netbus
 go 1.15
 
 require (
+	github.com/hashicorp/yamux v0.1.1
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -1,22 +1,301 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/aulang/netbus/config"
 	"github.com/aulang/netbus/core"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var server = flag.Bool("server", false, "启动服务端")
 var client = flag.Bool("client", false, "启动客户端")
 var generate = flag.Bool("generate", false, "创建客户端密钥")
 
+// TLS参数，优先于配置文件
+var tlsEnable = flag.Bool("tls", false, "客户端使用TLS连接服务端")
+var tlsCert = flag.String("tls-cert", "", "TLS证书文件")
+var tlsKey = flag.String("tls-key", "", "TLS私钥文件")
+var tlsCA = flag.String("tls-ca", "", "TLS CA证书文件，用于校验对端证书")
+var tlsServerName = flag.String("tls-server-name", "", "客户端校验的服务端证书名称")
+var tlsClientAuth = flag.Bool("tls-client-auth", false, "服务端强制要求客户端证书")
+
+// 域名代理参数，优先于配置文件
+var httpPort = flag.Uint("http-port", 0, "服务端HTTP域名代理共享端口")
+var httpsPort = flag.Uint("https-port", 0, "服务端HTTPS域名代理共享端口")
+
+// 心跳参数，单位为秒，优先于配置文件
+var heartbeatInterval = flag.Uint("heartbeat-interval", 0, "心跳间隔，单位秒")
+var heartbeatTimeout = flag.Uint("heartbeat-timeout", 0, "心跳超时时间，单位秒")
+var tcpKeepAlive = flag.Uint("tcp-keepalive", 0, "桥接连接TCP keepalive 间隔，单位秒")
+
+// 优雅停止超时时间，单位为秒，优先于配置文件
+var drainTimeout = flag.Uint("drain-timeout", 0, "收到停止信号后等待进行中的连接完成的超时时间，单位秒")
+
+// 管理接口参数，优先于配置文件
+var adminAddr = flag.String("admin-addr", "", "服务端管理接口监听地址")
+var adminToken = flag.String("admin-token", "", "服务端管理接口访问令牌")
+
+// 密钥吊销列表文件，优先于配置文件
+var revocationFile = flag.String("revocation-file", "", "服务端密钥吊销列表文件，每行一个密钥编号")
+
+// 只允许挑战应答认证，优先于配置文件
+var challengeAuthOnly = flag.Bool("challenge-auth-only", false, "服务端只允许挑战应答认证，拒绝握手时发送密钥的客户端")
+
+// 监控指标监听地址，优先于配置文件
+var metricsAddr = flag.String("metrics-addr", "", "Prometheus 监控指标监听地址")
+var metricsToken = flag.String("metrics-token", "", "Prometheus 监控指标访问令牌")
+
+// 客户端限速参数，优先于配置文件
+var clientRateLimit = flag.String("client-rate-limit", "", "服务端对每个客户端的限速，如 10MB")
+var clientRateBurst = flag.String("client-rate-burst", "", "服务端对每个客户端限速允许的突发流量，如 20MB")
+
+// 客户端连接数限制参数，优先于配置文件
+var clientMaxConns = flag.Uint("client-max-conns", 0, "服务端对每个客户端的最大并发访问连接数")
+var clientConnRate = flag.Uint("client-conn-rate", 0, "服务端对每个客户端的每秒新建访问连接数")
+var connQueueTimeout = flag.Uint("conn-queue-timeout", 0, "访问连接超出客户端连接数限制时排队等待的时间，单位秒，为0时直接拒绝")
+
+// 监听地址参数，优先于配置文件
+var bindAddr = flag.String("bind-addr", "", "服务端桥接端口监听地址，默认监听所有地址")
+var proxyBindAddr = flag.String("proxy-bind-addr", "", "服务端代理端口及域名代理共享端口监听地址，默认监听所有地址")
+
+// 所有代理端口的访问地址过滤参数，优先于配置文件
+var allowCIDRs = flag.String("allow", "", "允许访问代理端口的地址段，多个用逗号分隔，如 10.0.0.0/8,192.168.1.0/24")
+var denyCIDRs = flag.String("deny", "", "拒绝访问代理端口的地址段，多个用逗号分隔，优先于允许列表")
+
+// 客户端凭据编号，优先于配置文件
+var clientID = flag.String("client-id", "", "客户端使用服务端配置的客户端凭据时的客户端编号，密钥为凭据中的密钥")
+
+// 创建客户端密钥时的密钥声明参数
+var keyClientID = flag.String("key-client-id", "", "密钥声明的客户端编号")
+var keyPorts = flag.String("key-ports", "", "密钥允许的访问端口范围，多个用逗号分隔，如 10000-10010,13389")
+var keyTypes = flag.String("key-types", "", "密钥允许的代理类型，多个用逗号分隔，如 tcp,http")
+
+// 监听配置文件修改，自动重新加载
+var watch = flag.Bool("watch", false, "监听配置文件修改并自动重新加载")
+
+// 检查配置文件修改的间隔
+const watchInterval = 2 * time.Second
+
+func heartbeatArgs() config.HeartbeatConfig {
+	return config.HeartbeatConfig{
+		Interval:     time.Duration(*heartbeatInterval) * time.Second,
+		Timeout:      time.Duration(*heartbeatTimeout) * time.Second,
+		TCPKeepAlive: time.Duration(*tcpKeepAlive) * time.Second,
+	}
+}
+
+func tlsArgs() config.TLSConfig {
+	return config.TLSConfig{
+		Enable:     *tlsEnable,
+		CertFile:   *tlsCert,
+		KeyFile:    *tlsKey,
+		CAFile:     *tlsCA,
+		ServerName: *tlsServerName,
+		ClientAuth: *tlsClientAuth,
+	}
+}
+
+// 由命令行参数生成密钥声明，expired 为空时30天后过期
+func keyClaimsArgs(expired string) (config.KeyClaims, error) {
+	var claims config.KeyClaims
+	var err error
+	claims.ClientID = strings.TrimSpace(*keyClientID)
+	if claims.PortRanges, err = config.ParsePortRanges(*keyPorts); err != nil {
+		return claims, err
+	}
+	if claims.ProxyTypes, err = config.ParseProxyTypes(*keyTypes); err != nil {
+		return claims, err
+	}
+	claims.ExpiresAt, err = config.ParseKeyExpiry(expired)
+	return claims, err
+}
+
+// 使用命令行参数覆盖服务端配置
+func overrideServerConfig(serverConfig *config.ServerConfig) {
+	serverConfig.TLS.Override(tlsArgs())
+	serverConfig.Heartbeat.Override(heartbeatArgs())
+	if *httpPort != 0 {
+		serverConfig.HTTPPort = uint32(*httpPort)
+	}
+	if *httpsPort != 0 {
+		serverConfig.HTTPSPort = uint32(*httpsPort)
+	}
+	if *drainTimeout != 0 {
+		serverConfig.DrainTimeout = time.Duration(*drainTimeout) * time.Second
+	}
+	if *adminAddr != "" {
+		serverConfig.AdminAddr = *adminAddr
+	}
+	if *adminToken != "" {
+		serverConfig.AdminToken = *adminToken
+	}
+	if *revocationFile != "" {
+		serverConfig.RevocationFile = *revocationFile
+	}
+	if *challengeAuthOnly {
+		serverConfig.ChallengeAuthOnly = true
+	}
+	if *metricsAddr != "" {
+		serverConfig.MetricsAddr = *metricsAddr
+	}
+	if *metricsToken != "" {
+		serverConfig.MetricsToken = *metricsToken
+	}
+	if *clientRateLimit != "" {
+		limit, err := config.ParseRateLimit(*clientRateLimit, *clientRateBurst)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serverConfig.ClientRateLimit = limit
+	}
+	if *clientMaxConns != 0 || *clientConnRate != 0 {
+		serverConfig.ClientConnLimit = config.ConnLimit{
+			MaxConns:     int64(*clientMaxConns),
+			Rate:         int64(*clientConnRate),
+			QueueTimeout: time.Duration(*connQueueTimeout) * time.Second,
+		}
+	}
+	if *bindAddr != "" {
+		addr, err := config.ParseBindAddr(*bindAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serverConfig.BindAddr = addr
+	}
+	if *proxyBindAddr != "" {
+		addr, err := config.ParseBindAddr(*proxyBindAddr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serverConfig.ProxyBindAddr = addr
+	}
+	if *allowCIDRs != "" || *denyCIDRs != "" {
+		filter, err := config.ParseIPFilter(strings.Split(*allowCIDRs, ","), strings.Split(*denyCIDRs, ","))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serverConfig.IPFilter = filter
+	}
+}
+
+// 使用命令行参数覆盖客户端配置
+func overrideClientConfig(clientConfig *config.ClientConfig) {
+	clientConfig.TLS.Override(tlsArgs())
+	clientConfig.Heartbeat.Override(heartbeatArgs())
+	if *metricsAddr != "" {
+		clientConfig.MetricsAddr = *metricsAddr
+	}
+	if *metricsToken != "" {
+		clientConfig.MetricsToken = *metricsToken
+	}
+	if *clientID != "" {
+		clientConfig.ClientID = *clientID
+	}
+}
+
+// 服务端或者客户端
+type service interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+	Stop()
+	Wait() error
+}
+
+// 启动服务并等待其停止，出错时退出进程
+// 收到 SIGINT、SIGTERM 时优雅停止，再次收到信号时立即停止
+// 收到 SIGHUP 或者配置文件被修改时调用 reload 重新加载配置，reload 为空时不支持重新加载
+func run(s service, reload func() error) {
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("收到信号：[%s]，正在停止，再次发送信号立即停止\n", sig)
+
+		go func() {
+			<-signals
+			s.Stop()
+		}()
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Println("停止超时！", err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changed <-chan struct{}
+	if *watch && reload != nil {
+		changed = config.WatchConfigFile(watchInterval, nil)
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-changed:
+				log.Println("配置文件已修改")
+			}
+			if reload == nil {
+				log.Println("使用命令行参数启动，不支持重新加载配置")
+				continue
+			}
+			if err := reload(); err != nil {
+				log.Println("重新加载配置失败！", err)
+			}
+		}
+	}()
+
+	if err := s.Wait(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
 func printHelp() {
 	fmt.Println(`"-server" 加载 "config.yml" 启动服务端`)
 	fmt.Println(`"-client" 加载 "config.yml" 启动客户端`)
 	fmt.Println(`"-server <key> <port>" 启动服务端, 监听xxx端口', 如：-server 8888`)
 	fmt.Println(`"-client <key> <server:port> <local:port:serverPort>" 启动客户端，如：-client Aulang aulang.cn:8888 127.0.0.1:3306:13306`)
-	fmt.Println(`"-generate <key> [expired-time]" 创建客户端密钥, 如 -generate Aulang 2020-12-31`)
+	fmt.Println(`"-client <key> <server:port> <local:port:auto>" 由服务端分配访问端口，如：-client Aulang aulang.cn:8888 127.0.0.1:3306:auto`)
+	fmt.Println(`"-client <key> <server:port> <udp://local:port:serverPort>" 代理UDP服务，如：-client Aulang aulang.cn:8888 udp://127.0.0.1:53:10053`)
+	fmt.Println(`"-generate <key> [expired-time]" 创建客户端密钥，过期时间可以包含时分，默认30天后过期, 如 -generate Aulang 2020-12-31T18:00`)
+	fmt.Println(`"-generate [-key-client-id <id>] [-key-ports <ranges>] [-key-types <types>] <key> [expired-time]" 创建限制访问端口及代理类型的客户端密钥，如：-generate -key-client-id site-a -key-ports 13389,20000-20010 -key-types tcp Aulang 2020-12-31`)
+	fmt.Println(`"-client <key> <server:port> <http://local:port?domain=xxx>" 按域名代理HTTP服务，如：-client Aulang aulang.cn:8888 http://127.0.0.1:8080?domain=www.aulang.cn`)
+	fmt.Println(`"-client <key> <server:port> <https://local:port?domain=xxx>" 按SNI代理HTTPS服务，不解密数据，如：-client Aulang aulang.cn:8888 https://127.0.0.1:8443?domain=www.aulang.cn`)
+	fmt.Println(`"-http-port <port>" 服务端启用HTTP域名代理共享端口，如：-server -http-port 80 Aulang 8888 10000-20000`)
+	fmt.Println(`"-https-port <port>" 服务端启用HTTPS域名代理共享端口，如：-server -https-port 443 Aulang 8888 10000-20000`)
+	fmt.Println(`"-tls-cert <file> -tls-key <file>" 服务端桥接端口启用TLS，如：-server -tls-cert server.crt -tls-key server.key`)
+	fmt.Println(`"-tls [-tls-ca <file>] [-tls-server-name <name>]" 客户端使用TLS连接服务端，如：-client -tls -tls-ca ca.crt`)
+	fmt.Println(`"-tls-ca <file> [-tls-client-auth]" 服务端使用CA校验客户端证书，证书认证的客户端无需密钥`)
+	fmt.Println(`"-tls-cert <file> -tls-key <file>" 客户端使用证书认证，如：-client -tls -tls-ca ca.crt -tls-cert site.crt -tls-key site.key`)
+	fmt.Println(`"-heartbeat-interval <seconds> -heartbeat-timeout <seconds>" 心跳间隔及超时时间，超时未收到对端消息则断开重连，默认 10 秒、30 秒`)
+	fmt.Println(`"-tcp-keepalive <seconds>" 桥接连接TCP keepalive 间隔，默认 15 秒`)
+	fmt.Println(`"-drain-timeout <seconds>" 服务端收到 SIGINT、SIGTERM 后等待进行中的连接完成的超时时间，默认 30 秒`)
+	fmt.Println(`"-admin-addr <host:port> [-admin-token <token>]" 服务端启用管理接口，查看及关闭代理通道、断开客户端，监听非本机地址时须指定访问令牌，如：-server -admin-addr 127.0.0.1:8000`)
+	fmt.Println(`"-revocation-file <file>" 服务端从文件加载已吊销的密钥编号，每行一个，文件修改后自动重新加载，也可通过管理接口吊销，如：-server -revocation-file revoked.txt`)
+	fmt.Println(`"-client -client-id <id> <secret> <server:port> <local:port:serverPort>" 使用服务端配置的客户端凭据，凭据配置的访问端口及域名只有该客户端可以使用，如：-client -client-id office-a s3cret aulang.cn:8888 127.0.0.1:3389:13389`)
+	fmt.Println(`"-challenge-auth-only" 服务端只允许挑战应答认证，密钥不在网络中传输，拒绝旧版客户端及旧版密钥，如：-server -challenge-auth-only Aulang 8888 10000-20000`)
+	fmt.Println(`"-metrics-addr <host:port> [-metrics-token <token>]" 启用 Prometheus 监控指标，通过 /metrics 访问，监听非本机地址时须指定访问令牌，如：-client -metrics-addr 127.0.0.1:9101`)
+	fmt.Println(`"-client-rate-limit <rate> [-client-rate-burst <burst>]" 服务端对每个客户端限速，单位字节每秒，支持 K、M、G，如：-server -client-rate-limit 10MB`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?rate=xxx&burst=xxx>" 按代理限速，如：-client Aulang aulang.cn:8888 127.0.0.1:8080:18080?rate=1MB`)
+	fmt.Println(`"-client-max-conns <n> -client-conn-rate <n> [-conn-queue-timeout <seconds>]" 服务端限制每个客户端的并发及每秒新建访问连接数，超出时排队或者拒绝，如：-server -client-max-conns 100`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?max-conns=xxx&conn-rate=xxx&queue-timeout=xxx>" 按代理限制访问连接数，如：-client Aulang aulang.cn:8888 127.0.0.1:3306:13306?max-conns=20`)
+	fmt.Println(`"-allow <cidr,...> -deny <cidr,...>" 服务端只允许或者拒绝指定地址段访问所有代理端口，拒绝优先，如：-server -allow 10.0.0.0/8,192.168.1.0/24`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?allow=xxx&deny=xxx>" 按代理过滤访问地址，可重复，如：-client Aulang aulang.cn:8888 127.0.0.1:3389:13389?allow=10.0.0.0/8`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?proxy-protocol=v1|v2>" 连接本地服务时发送 PROXY protocol 头传递访问者地址，如：-client Aulang aulang.cn:8888 127.0.0.1:80:18080?proxy-protocol=v2`)
+	fmt.Println(`"-bind-addr <ip> -proxy-bind-addr <ip>" 服务端桥接端口及代理端口只监听指定地址，如：-server -proxy-bind-addr 10.0.0.1 Aulang 8888 10000-20000`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?bind=xxx>" 指定服务端监听代理端口的地址，服务端未指定监听地址时可用，如：-client Aulang aulang.cn:8888 127.0.0.1:3389:13389?bind=10.0.0.1`)
+	fmt.Println(`"-client <key> <server:port> <local:port:serverPort?group=xxx&balance=round-robin|least-conn|weighted&weight=n>" 多个客户端使用相同组名共享访问端口，由服务端负载均衡，客户端断开时自动切换，不同客户端需在客户端凭据中都配置该端口，如：-client Aulang aulang.cn:8888 127.0.0.1:80:18080?group=web`)
+	fmt.Println(`"-client <key> <[ipv6]:port> <[ipv6]:port:serverPort>" IPv6 地址使用方括号，如：-client Aulang [2001:db8::1]:8888 [::1]:3306:13306`)
+	fmt.Println(`"-watch" 监听 "config.yml" 修改并自动重新加载，也可发送 SIGHUP 重新加载，如：-client -watch`)
 }
 
 func main() {
@@ -26,10 +305,38 @@ func main() {
 
 	if *server {
 		serverConfig := config.InitServerConfig(argsConfig)
-		core.Server(serverConfig)
+		overrideServerConfig(&serverConfig)
+		netbusServer := core.NewServer(serverConfig)
+
+		var reload func() error
+		if len(argsConfig) == 0 {
+			reload = func() error {
+				serverConfig, err := config.ReloadServerConfig()
+				if err != nil {
+					return err
+				}
+				overrideServerConfig(&serverConfig)
+				return netbusServer.Reload(serverConfig)
+			}
+		}
+		run(netbusServer, reload)
 	} else if *client {
 		clientConfig := config.InitClientConfig(argsConfig)
-		core.Client(clientConfig)
+		overrideClientConfig(&clientConfig)
+		netbusClient := core.NewClient(clientConfig)
+
+		var reload func() error
+		if len(argsConfig) == 0 {
+			reload = func() error {
+				clientConfig, err := config.ReloadClientConfig()
+				if err != nil {
+					return err
+				}
+				overrideClientConfig(&clientConfig)
+				return netbusClient.Reload(clientConfig)
+			}
+		}
+		run(netbusClient, reload)
 	} else if *generate {
 		var seed, expired string
 		if len(argsConfig) > 0 {
@@ -39,8 +346,18 @@ func main() {
 			expired = argsConfig[1]
 		}
 		if len(argsConfig) > 0 {
-			trialKey, _ := config.NewKey(seed, expired)
+			claims, err := keyClaimsArgs(expired)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			trialKey, err := config.NewKey(seed, claims)
+			if err != nil {
+				log.Fatalln("创建客户端密钥失败！", err)
+			}
+			// 输出解析之后的声明，包含生成的密钥编号
+			claims, _ = config.CheckKey(seed, trialKey)
 			fmt.Printf("客户端密钥：%s\n", trialKey)
+			fmt.Printf("密钥声明：%s\n", claims)
 		}
 	} else {
 		printHelp()
@@ -1,9 +1,38 @@
 package test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/aulang/netbus/config"
 	"github.com/aulang/netbus/core"
+	"github.com/hashicorp/yamux"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
@@ -13,7 +42,11 @@ func TestServer(t *testing.T) {
 		MinProxyPort: 10000,
 		MaxProxyPort: 20000,
 	}
-	core.Server(cfg)
+	server := core.NewServer(cfg)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = server.Wait()
 }
 
 func TestClient(t *testing.T) {
@@ -23,9 +56,2234 @@ func TestClient(t *testing.T) {
 			Host: "127.0.0.1", Port: 8888,
 		},
 		ProxyAddrs: []config.NetAddress{
-			{"127.0.0.1", 7001, 17001},
+			{Host: "127.0.0.1", Port: 7001, ProxyPort: 17001},
+		},
+	}
+	client := core.NewClient(cfg)
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 同一进程中启动两个服务端，取消 ctx 后停止
+func TestEmbeddedServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var servers []*core.Server
+	for _, port := range []uint32{18881, 18882} {
+		server := core.NewServer(config.ServerConfig{
+			Key:          "Aulang",
+			Port:         port,
+			MinProxyPort: 10000,
+			MaxProxyPort: 20000,
+		})
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+
+	// 端口已被占用时返回错误，不退出进程，启动失败的服务端 Wait 立即返回
+	failed := core.NewServer(config.ServerConfig{Key: "Aulang", Port: 18881})
+	if err := failed.Start(ctx); err == nil {
+		t.Fatal("重复监听端口应当失败")
+	}
+	waited := make(chan struct{})
+	go func() {
+		_ = failed.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("启动失败的服务端 Wait 未返回")
+	}
+
+	cancel()
+	for _, server := range servers {
+		if err := server.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 管理接口校验访问令牌
+func TestAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18883,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18884",
+		AdminToken:   "secret",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/api/tunnels", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tunnels", "secret", http.StatusOK},
+		{http.MethodGet, "/api/clients", "secret", http.StatusOK},
+		{http.MethodDelete, "/api/tunnels/17001", "secret", http.StatusNotFound},
+		{http.MethodDelete, "/api/clients/1", "secret", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, "http://127.0.0.1:18884"+test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("%s %s 返回 %d，期望 %d", test.method, test.path, response.StatusCode, test.status)
+		}
+	}
+
+	// 监听非本机地址时必须配置访问令牌
+	for addr, valid := range map[string]bool{":18889": false, "0.0.0.0:18889": false, "localhost:18889": true} {
+		other := core.NewServer(config.ServerConfig{Key: "Aulang", Port: 18892, MinProxyPort: 10000, MaxProxyPort: 20000, AdminAddr: addr})
+		otherCtx, otherCancel := context.WithCancel(ctx)
+		err := other.Start(otherCtx)
+		if (err == nil) != valid {
+			t.Errorf("管理接口监听 %s 未配置访问令牌，启动结果：%v", addr, err)
+		}
+		otherCancel()
+		if err == nil {
+			_ = other.Wait()
+		}
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 监控指标校验访问令牌，监听非本机地址时必须配置访问令牌
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18900,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		MetricsAddr:  "127.0.0.1:18901",
+		MetricsToken: "secret",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		request, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:18901/metrics", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if response.StatusCode != status {
+			t.Errorf("访问令牌 %q 返回 %d，期望 %d", token, response.StatusCode, status)
+		}
+		if status == http.StatusOK && !strings.Contains(string(body), "netbus_sessions 0") {
+			t.Error("监控指标内容不对", string(body))
+		}
+	}
+
+	other := core.NewServer(config.ServerConfig{Key: "Aulang", Port: 18902, MinProxyPort: 10000, MaxProxyPort: 20000, MetricsAddr: ":18903"})
+	if err := other.Start(ctx); err == nil {
+		t.Error("监控指标端口监听非本机地址且未配置访问令牌时启动成功")
+	}
+	client := core.NewClient(config.ClientConfig{
+		Key:         "Aulang",
+		ServerAddr:  config.NetAddress{Host: "127.0.0.1", Port: 18900},
+		MetricsAddr: "0.0.0.0:18903",
+	})
+	if err := client.Start(ctx); err == nil {
+		client.Stop()
+		t.Error("客户端监控指标端口监听非本机地址且未配置访问令牌时启动成功")
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 新版密钥携带声明，篡改或者种子不同时校验失败，格式错误的旧版密钥不会崩溃
+func TestKeyClaims(t *testing.T) {
+	ports, _ := config.ParsePortRanges("13389,20000-20010")
+	expiry, _ := config.ParseKeyExpiry("2099-12-31T18:00")
+	key, err := config.NewKey("Aulang", config.KeyClaims{
+		ClientID:   "site-a",
+		PortRanges: ports,
+		ProxyTypes: []string{config.ProxyTypeTCP},
+		ExpiresAt:  expiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, ok := config.CheckKey("Aulang", key)
+	if !ok || claims.ID == "" || claims.ClientID != "site-a" || !claims.ExpiresAt.Equal(expiry) || claims.IssuedAt.IsZero() {
+		t.Fatal("密钥声明不一致", claims)
+	}
+	if !claims.AllowPort(20005) || claims.AllowPort(20011) || claims.AllowProxyType(config.ProxyTypeUDP) {
+		t.Fatal("密钥声明限制不对", claims)
+	}
+
+	tampered := key[:len(key)-2] + "AA"
+	if tampered == key {
+		tampered = key[:len(key)-2] + "BB"
+	}
+	for _, k := range []string{tampered, "AAAA", "QUFBQUFBQUFBQUFBQUFBQQ=="} {
+		if _, ok := config.CheckKey("Aulang", k); ok {
+			t.Fatal("无效密钥校验通过", k)
+		}
+		if _, err := config.ParseKey("Aulang", k); err == nil {
+			t.Fatal("无效密钥解析成功", k)
+		}
+	}
+	if _, ok := config.CheckKey("Other", key); ok {
+		t.Fatal("其他种子校验通过")
+	}
+
+	// 挑战应答认证只发送公开部分，公开部分本身不能作为密钥使用
+	token, secret, ok := config.SplitKey(key)
+	if !ok || string(config.KeySecret("Aulang", token)) != string(secret) {
+		t.Fatal("密钥公开部分推导的密文不一致")
+	}
+	if _, ok := config.CheckKeyToken("Aulang", token); !ok {
+		t.Fatal("密钥公开部分校验失败")
+	}
+	if _, ok := config.CheckKey("Aulang", token); ok {
+		t.Fatal("缺少认证密文的密钥校验通过")
+	}
+
+	other, _ := config.NewKey("Aulang", config.KeyClaims{ExpiresAt: expiry})
+	if otherClaims, _ := config.CheckKey("Aulang", other); otherClaims.ID == claims.ID {
+		t.Fatal("密钥编号重复", claims.ID)
+	}
+
+	// 之前生成的第二版密钥仍然有效，但无法推导密文，握手时发送整个密钥
+	keyV2 := "v2.m0tCwd5eNYLp16SlagMIb2iXlTG-ruN-PyHsC08WkWpHV9FdPdIsbS_EwrqzdLSIO5-kJGpYiz1BaY1_utKAZlrDfUoeuxjEfa2eJalPHKiZJJM88jwHsA"
+	if claimsV2, ok := config.CheckKey("Aulang", keyV2); !ok || claimsV2.ID != "a4bb341e00d10df6" {
+		t.Fatal("第二版密钥校验失败", claimsV2)
+	}
+	if _, _, ok := config.SplitKey(keyV2); ok || config.KeySecret("Aulang", keyV2) != nil || config.KeyFormatDeprecated(keyV2) {
+		t.Fatal("第二版密钥不能推导密文")
+	}
+
+	// 新版密钥的公开部分改为第二版前缀之后不能作为完整密钥使用，带认证密文的第二版密钥已废弃
+	if !strings.HasPrefix(key, "v3.") {
+		t.Fatal("新版密钥前缀不对", key)
+	}
+	relabelled := "v2." + strings.TrimPrefix(token, "v3.")
+	if _, ok := config.CheckKey("Aulang", relabelled); ok {
+		t.Fatal("修改前缀的密钥校验通过")
+	}
+	deprecated := "v2." + strings.TrimPrefix(key, "v3.")
+	if !config.KeyFormatDeprecated(deprecated) {
+		t.Fatal("废弃的密钥格式未识别")
+	}
+	if _, ok := config.CheckKey("Aulang", deprecated); ok {
+		t.Fatal("废弃的密钥格式校验通过")
+	}
+}
+
+// 解析网络地址，IPv6 地址须使用方括号，端口超出范围时失败
+func TestParseNetAddress(t *testing.T) {
+	tests := []struct {
+		address   string
+		ok        bool
+		host      string
+		port      uint32
+		proxyPort uint32
+	}{
+		{"127.0.0.1:3389:13389", true, "127.0.0.1", 3389, 13389},
+		{"[::1]:8080", true, "::1", 8080, 8080},
+		{"[2001:db8::1]:3306:13306?bind=[::1]", true, "2001:db8::1", 3306, 13306},
+		{"[::1:8080", false, "", 0, 0},
+		{"[::1]8080", false, "", 0, 0},
+		{"[not-ip]:8080", false, "", 0, 0},
+		{"::1:8080", false, "", 0, 0},
+		{"2001:db8::1:3306:13306", false, "", 0, 0},
+		{"127.0.0.1:70000", false, "", 0, 0},
+		{"[::1]:8080:65536", false, "", 0, 0},
+		{"127.0.0.1:0", false, "", 0, 0},
+	}
+	for _, test := range tests {
+		addr, ok := config.ParseNetAddress(test.address)
+		if ok != test.ok {
+			t.Errorf("解析 %s 结果为 %v，期望 %v", test.address, ok, test.ok)
+			continue
+		}
+		if ok && (addr.Host != test.host || addr.Port != test.port || addr.ProxyPort != test.proxyPort) {
+			t.Errorf("解析 %s 为 %s:%d:%d", test.address, addr.Host, addr.Port, addr.ProxyPort)
+		}
+	}
+
+	bindAddrs := []struct {
+		addr     string
+		expected string
+		ok       bool
+	}{
+		{"", "", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"[::1]", "::1", true},
+		{"::1", "::1", true},
+		{"[::1", "", false},
+		{"::1]", "", false},
+		{"[]", "", false},
+		{"[ ]", "", false},
+		{"[", "", false},
+		{"127.0.0.1:8080", "", false},
+		{"[::1]:8080", "", false},
+	}
+	for _, test := range bindAddrs {
+		addr, err := config.ParseBindAddr(test.addr)
+		if (err == nil) != test.ok || addr != test.expected {
+			t.Errorf("解析监听地址 %s 为 %q，错误：%v", test.addr, addr, err)
+		}
+	}
+}
+
+// 访问地址过滤：拒绝列表优先，单个IP只匹配该地址，未配置时允许所有地址，配置了过滤但无法取得IP时拒绝
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		allow   []string
+		deny    []string
+		ip      string
+		allowed bool
+	}{
+		{nil, nil, "203.0.113.1", true},
+		{nil, nil, "", true},
+		{[]string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, nil, "192.168.1.1", false},
+		{nil, []string{"10.0.0.0/8"}, "10.1.2.3", false},
+		{nil, []string{"10.0.0.0/8"}, "192.168.1.1", true},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.1", false},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.2", true},
+		{[]string{"10.0.0.1"}, []string{"10.0.0.0/8"}, "10.0.0.1", false},
+		{[]string{"10.0.0.1"}, nil, "10.0.0.2", false},
+		{[]string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{[]string{"2001:db8::1"}, nil, "2001:db8::2", false},
+		{[]string{"10.0.0.0/8"}, nil, "", false},
+	}
+	for _, test := range tests {
+		filter, err := config.ParseIPFilter(test.allow, test.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := filter.Allowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("允许%v，拒绝%v，访问地址 [%s] 结果为 %v", test.allow, test.deny, test.ip, allowed)
+		}
+	}
+	for _, invalid := range []string{"10.0.0.256", "10.0.0.0/33", "example.com"} {
+		if _, err := config.ParseIPFilter([]string{invalid}, nil); err == nil {
+			t.Error("地址段格式错误时解析成功", invalid)
+		}
+	}
+}
+
+// 代理及服务端端口过滤拒绝的访问连接被关闭，并计入拒绝的访问连接数
+func TestIPFilterDeny(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portFilter, _ := config.ParseIPFilter(nil, []string{"127.0.0.0/8"})
+	server := core.NewServer(config.ServerConfig{
+		Key:           "Aulang",
+		Port:          18894,
+		MinProxyPort:  10000,
+		MaxProxyPort:  20000,
+		AdminAddr:     "127.0.0.1:18895",
+		PortIPFilters: map[uint32]config.IPFilter{18898: portFilter},
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("ok"))
+		_ = conn.Close()
+	})
+	allowed, _ := config.ParseNetAddress(backend + ":18896?allow=127.0.0.1")
+	denied, _ := config.ParseNetAddress(backend + ":18897?allow=10.0.0.0/8")
+	serverDenied, _ := config.ParseNetAddress(backend + ":18898")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18894},
+		ProxyAddrs: []config.NetAddress{allowed, denied, serverDenied},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18895", 18896, 18897, 18898)
+
+	for port, expected := range map[int]string{18896: "ok", 18897: "", 18898: ""} {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readVisit(conn, 2); body != expected {
+			t.Errorf("访问端口 [%d] 返回 %q，期望 %q", port, body, expected)
+		}
+		_ = conn.Close()
+	}
+
+	response, err := http.Get("http://127.0.0.1:18895/api/tunnels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tunnels []struct {
+		Port   uint32 `json:"port"`
+		Denied int64  `json:"denied_conns"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&tunnels)
+	_ = response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tunnel := range tunnels {
+		if expected := map[uint32]int64{18896: 0, 18897: 1, 18898: 1}[tunnel.Port]; tunnel.Denied != expected {
+			t.Errorf("访问端口 [%d] 拒绝的访问连接数为 %d，期望 %d", tunnel.Port, tunnel.Denied, expected)
+		}
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+func TestRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.txt")
+	if ids, err := config.LoadRevocationList(path); err != nil || len(ids) != 0 {
+		t.Fatal("文件不存在时应返回空列表", ids, err)
+	}
+
+	if err := config.SaveRevocationList(path, map[string]bool{"b2": true, "a1": true}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("\n  # 注释\n  c3  \n")
+	_ = f.Close()
+
+	ids, err := config.LoadRevocationList(path)
+	if err != nil || len(ids) != 3 || !ids["a1"] || !ids["b2"] || !ids["c3"] {
+		t.Fatal("吊销列表不一致", ids, err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	ports, _ := config.ParsePortRanges("13389,20000-20010")
+	cfg := config.ServerConfig{
+		Key: "Aulang",
+		Credentials: map[string]config.ClientCredential{
+			"office-a": {ID: "office-a", Secret: "s3cret", PortRanges: ports, Domains: []string{"*.a.aulang.cn"}},
 		},
-		TunnelCount: 1,
 	}
-	core.Client(cfg)
+
+	token := config.CredentialToken("office-a")
+	if claims, ok := cfg.CheckKeyToken(token); !ok || claims.ClientID != "office-a" {
+		t.Fatal("客户端凭据校验失败", claims)
+	}
+	if string(cfg.KeySecret(token)) != "s3cret" || cfg.KeySecret(config.CredentialToken("office-b")) != nil {
+		t.Fatal("客户端凭据密文不对")
+	}
+	if !cfg.PortReserved(20005, "office-b") || cfg.PortReserved(20005, "office-a") || cfg.PortReserved(20011, "office-b") {
+		t.Fatal("访问端口归属不对")
+	}
+	if !cfg.CredentialOwnsPort(20005, "office-a") || cfg.CredentialOwnsPort(20005, "office-b") || cfg.GroupPortReserved(20005, "office-a") {
+		t.Fatal("负载均衡组访问端口归属不对")
+	}
+	if !cfg.DomainReserved("www.a.aulang.cn", "") || cfg.DomainReserved("a.aulang.cn", "") {
+		t.Fatal("访问域名归属不对")
+	}
+}
+
+// 两个客户端加入同一负载均衡组，访问连接轮流分配，一个客户端断开之后全部分配给另一个
+// 使用其他密钥的客户端即使知道组名也不能加入
+func TestProxyGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18885,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 访问 count 次，返回各客户端分配到的次数
+	visit := func(count int) map[string]int {
+		visits := make(map[string]int)
+		for i := 0; i < count; i++ {
+			conn, err := net.DialTimeout("tcp", "127.0.0.1:18886", time.Second)
+			if err != nil {
+				continue
+			}
+			_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+			body, _ := ioutil.ReadAll(conn)
+			_ = conn.Close()
+			visits[string(body)]++
+		}
+		return visits
+	}
+	waitFor := func(check func(visits map[string]int) bool) map[string]int {
+		var visits map[string]int
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if visits = visit(4); check(visits) {
+				break
+			}
+		}
+		return visits
+	}
+
+	// 启动客户端，本地服务返回客户端名称
+	startClient := func(name string, key string) *core.Client {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			<-ctx.Done()
+			_ = listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(name))
+				_ = conn.Close()
+			}
+		}()
+
+		proxyAddr, _ := config.ParseNetAddress(listener.Addr().String() + ":18886?group=web")
+		client := core.NewClient(config.ClientConfig{
+			Key:        key,
+			ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18885},
+			ProxyAddrs: []config.NetAddress{proxyAddr},
+		})
+		if err := client.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	// 第一个客户端创建组之后再启动其他客户端
+	a := startClient("a", "Aulang")
+	defer a.Stop()
+	if visits := waitFor(func(visits map[string]int) bool { return visits["a"] == 4 }); visits["a"] != 4 {
+		t.Fatal("负载均衡组未创建", visits)
+	}
+
+	expiry, _ := config.ParseKeyExpiry("2099-12-31")
+	otherKey, _ := config.NewKey("Aulang", config.KeyClaims{ExpiresAt: expiry})
+	c := startClient("c", otherKey)
+	defer c.Stop()
+	b := startClient("b", "Aulang")
+	defer b.Stop()
+
+	if visits := waitFor(func(visits map[string]int) bool { return visits["a"] == 2 && visits["b"] == 2 }); visits["a"] != 2 || visits["b"] != 2 {
+		t.Fatal("访问连接未轮流分配", visits)
+	}
+	for i := 0; i < 3; i++ {
+		if visits := visit(4); visits["c"] != 0 {
+			t.Fatal("其他密钥的客户端加入了负载均衡组", visits)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	a.Stop()
+	if visits := waitFor(func(visits map[string]int) bool { return visits["b"] == 4 }); visits["b"] != 4 {
+		t.Fatal("客户端断开之后未切换到组内其他客户端", visits)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 启动本地服务，ctx 取消时停止，返回监听地址
+func startBackend(ctx context.Context, t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// 通过管理接口等待访问端口注册完成，不建立访问连接，避免影响连接数限制
+func waitForTunnels(t *testing.T, adminAddr string, ports ...uint32) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		response, err := http.Get("http://" + adminAddr + "/api/tunnels")
+		if err != nil {
+			continue
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		registered := true
+		for _, port := range ports {
+			registered = registered && strings.Contains(string(body), fmt.Sprintf(`"port": %d,`, port))
+		}
+		if registered {
+			return
+		}
+	}
+	t.Fatal("访问端口未注册", ports)
+}
+
+// 读取访问连接返回的数据，被拒绝时为空
+func readVisit(conn net.Conn, size int) string {
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, size)
+	n, _ := io.ReadFull(conn, buf)
+	return string(buf[:n])
+}
+
+// 新建连接限速创建时即可突发，排队时间为0时也能准入；超出最大连接数被拒绝时归还新建连接的令牌
+func TestConnLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18887,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18888",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 本地服务返回 ok，访问者断开之后关闭
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("ok"))
+		_, _ = io.Copy(ioutil.Discard, conn)
+		_ = conn.Close()
+	})
+	burstAddr, _ := config.ParseNetAddress(backend + ":18890?conn-rate=5&conn-burst=10")
+	maxConnsAddr, _ := config.ParseNetAddress(backend + ":18891?max-conns=1&conn-rate=1&conn-burst=2")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18887},
+		ProxyAddrs: []config.NetAddress{burstAddr, maxConnsAddr},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18888", 18890, 18891)
+
+	visit := func(port int) (net.Conn, string) {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, readVisit(conn, 2)
+	}
+
+	for i := 0; i < 10; i++ {
+		conn, body := visit(18890)
+		_ = conn.Close()
+		if body != "ok" {
+			t.Fatalf("突发范围内的第 %d 个访问连接被拒绝", i+1)
+		}
+	}
+	if conn, body := visit(18890); body != "" {
+		_ = conn.Close()
+		t.Fatal("超出突发的访问连接未被拒绝")
+	}
+
+	first, body := visit(18891)
+	if body != "ok" {
+		t.Fatal("第一个访问连接被拒绝")
+	}
+	if conn, body := visit(18891); body != "" {
+		_ = conn.Close()
+		t.Fatal("超出最大连接数的访问连接未被拒绝")
+	}
+	_ = first.Close()
+	time.Sleep(100 * time.Millisecond)
+	third, body := visit(18891)
+	_ = third.Close()
+	if body != "ok" {
+		t.Fatal("超出最大连接数被拒绝时未归还令牌")
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 握手协议，同 core.Protocol 的 JSON 格式
+type handshake struct {
+	Result       byte     `json:"result"`
+	Version      uint32   `json:"version"`
+	Port         uint32   `json:"port,omitempty"`
+	Key          string   `json:"key,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Message      string   `json:"message,omitempty"`
+	Token        string   `json:"token,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
+	Timestamp    int64    `json:"timestamp,omitempty"`
+	Proof        string   `json:"proof,omitempty"`
+}
+
+// 发送握手请求并接收响应，格式为 协议长度(4字节)|JSON协议体
+func exchange(t *testing.T, conn net.Conn, request handshake) handshake {
+	body, _ := json.Marshal(request)
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, uint32(len(body)))
+	if _, err := conn.Write(append(head, body...)); err != nil {
+		t.Fatal(err)
+	}
+
+	var response handshake
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal("接收握手响应失败", err)
+	}
+	body = make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal("接收握手响应失败", err)
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// 建立多路复用会话，ctx 取消时关闭
+func dialSession(ctx context.Context, t *testing.T, addr string) *yamux.Session {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = session.Close()
+	}()
+	return session
+}
+
+// 打开数据流
+func openStream(t *testing.T, session *yamux.Session) net.Conn {
+	stream, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// 认证挑战的证明，同 core.authProof
+func challengeProof(secret string, challenge handshake, port uint32, token string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "netbus-auth|%s|%d|%d|%s", challenge.Nonce, challenge.Timestamp, port, token)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 挑战应答认证：证明正确时通过，其他连接的证明不能重放，证明错误时认证失败
+// 只允许挑战应答认证时拒绝发送密钥的请求，会话认证之后的工作连接不再挑战
+func TestChallengeAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const addr = "127.0.0.1:18893"
+	server := core.NewServer(config.ServerConfig{
+		Key:               "Aulang",
+		Port:              18893,
+		MinProxyPort:      10000,
+		MaxProxyPort:      20000,
+		ChallengeAuthOnly: true,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := handshake{Result: 1, Version: 4}
+
+	// 超级密钥的公开部分为空，密文为种子本身
+	authenticated := dialSession(ctx, t, addr)
+	control := openStream(t, authenticated)
+	challenge := exchange(t, control, hello)
+	if challenge.Result != 8 || challenge.Nonce == "" || challenge.Timestamp == 0 {
+		t.Fatal("未返回认证挑战", challenge)
+	}
+	answer := hello
+	answer.Proof = challengeProof("Aulang", challenge, 0, "")
+	if result := exchange(t, control, answer); result.Result != 1 {
+		t.Fatal("证明正确时认证失败", result)
+	}
+
+	// 已认证会话中的工作连接不再挑战，直接检查访问端口
+	work := openStream(t, authenticated)
+	if result := exchange(t, work, handshake{Result: 1, Version: 4, Port: 17999}); result.Result != 5 {
+		t.Fatal("已认证会话的工作连接未随会话认证", result)
+	}
+
+	// 未认证会话中的工作连接需要挑战
+	work = openStream(t, dialSession(ctx, t, addr))
+	if result := exchange(t, work, handshake{Result: 1, Version: 4, Port: 17999}); result.Result != 8 {
+		t.Fatal("未认证会话的工作连接未被挑战", result)
+	}
+
+	// 其他连接的随机数不同，重放证明认证失败
+	replayed := openStream(t, dialSession(ctx, t, addr))
+	if result := exchange(t, replayed, hello); result.Result != 8 || result.Nonce == challenge.Nonce {
+		t.Fatal("认证挑战的随机数重复", result)
+	}
+	if result := exchange(t, replayed, answer); result.Result != 3 {
+		t.Fatal("重放的证明认证通过", result)
+	}
+
+	// 证明错误
+	wrong := openStream(t, dialSession(ctx, t, addr))
+	challenge = exchange(t, wrong, hello)
+	answer.Proof = challengeProof("Other", challenge, 0, "")
+	if result := exchange(t, wrong, answer); result.Result != 3 {
+		t.Fatal("证明错误时认证通过", result)
+	}
+
+	// 发送密钥的请求被拒绝，即使密钥正确
+	legacy := openStream(t, dialSession(ctx, t, addr))
+	if result := exchange(t, legacy, handshake{Result: 1, Version: 3, Key: "Aulang"}); result.Result != 4 {
+		t.Fatal("只允许挑战应答认证时发送密钥的请求未被拒绝", result)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 客户端共享的最大连接数拒绝访问者时，代理自身已取得的新建连接令牌同样归还
+func TestConnLimitRefund(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:             "Aulang",
+		Port:            18904,
+		MinProxyPort:    10000,
+		MaxProxyPort:    20000,
+		AdminAddr:       "127.0.0.1:18905",
+		ClientConnLimit: config.ConnLimit{MaxConns: 1},
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("ok"))
+		_, _ = io.Copy(ioutil.Discard, conn)
+		_ = conn.Close()
+	})
+	proxyAddr, _ := config.ParseNetAddress(backend + ":18906?conn-rate=1&conn-burst=2")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18904},
+		ProxyAddrs: []config.NetAddress{proxyAddr},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18905", 18906)
+
+	visit := func() (net.Conn, string) {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:18906", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, readVisit(conn, 2)
+	}
+
+	first, body := visit()
+	if body != "ok" {
+		t.Fatal("第一个访问连接被拒绝")
+	}
+	if conn, body := visit(); body != "" {
+		_ = conn.Close()
+		t.Fatal("超出客户端最大连接数的访问连接未被拒绝")
+	}
+	_ = first.Close()
+	time.Sleep(100 * time.Millisecond)
+	third, body := visit()
+	_ = third.Close()
+	if body != "ok" {
+		t.Fatal("客户端最大连接数拒绝时代理未归还令牌")
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// UDP代理按数据包转发，本地服务的响应按原访问者返回，不同访问者的会话互不影响
+func TestUDPProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18907,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18908",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 本地服务在数据包前加上 echo: 原样返回
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = backend.Close()
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	proxyAddr, _ := config.ParseNetAddress("udp://" + backend.LocalAddr().String() + ":18910")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18907},
+		ProxyAddrs: []config.NetAddress{proxyAddr},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18908", 18910)
+
+	var visitors []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:18910")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		visitors = append(visitors, conn)
+	}
+	buf := make([]byte, 2048)
+	for round := 0; round < 3; round++ {
+		for i, conn := range visitors {
+			payload := fmt.Sprintf("visitor-%d-%d", i, round)
+			if _, err := conn.Write([]byte(payload)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal("未收到UDP响应", payload, err)
+			}
+			if string(buf[:n]) != "echo:"+payload {
+				t.Fatalf("UDP响应为 %q，期望 %q", buf[:n], "echo:"+payload)
+			}
+		}
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 启动HTTP本地服务，返回 name 及请求的 Host，ctx 取消时停止，返回监听地址
+func startHTTPBackend(ctx context.Context, t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s:%s", name, r.Host)
+	})}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() { _ = server.Serve(listener) }()
+	return listener.Addr().String()
+}
+
+// 按 Host 请求头转发给对应的客户端，支持泛域名，未注册的域名返回 404
+// 同一条长连接中 Host 不同的请求不会被转发给第一个请求的客户端
+func TestHTTPVhost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18911,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		HTTPPort:     18912,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := config.ParseNetAddress("http://" + startHTTPBackend(ctx, t, "a") + "?domain=a.test&domain=*.a.test")
+	b, _ := config.ParseNetAddress("http://" + startHTTPBackend(ctx, t, "b") + "?domain=b.test")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18911},
+		ProxyAddrs: []config.NetAddress{a, b},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// 默认客户端复用长连接
+	httpClient := &http.Client{Timeout: 3 * time.Second}
+	get := func(host string) (int, string) {
+		request, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:18912/", nil)
+		request.Host = host
+		response, err := httpClient.Do(request)
+		if err != nil {
+			return 0, err.Error()
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return response.StatusCode, string(body)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		statusA, _ := get("a.test")
+		statusB, _ := get("b.test")
+		if statusA == http.StatusOK && statusB == http.StatusOK {
+			break
+		}
+	}
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"a.test", http.StatusOK, "a:a.test"},
+		{"b.test:18912", http.StatusOK, "b:b.test:18912"},
+		{"www.a.test", http.StatusOK, "a:www.a.test"},
+		{"B.TEST", http.StatusOK, "b:B.TEST"},
+		{"a.test", http.StatusOK, "a:a.test"},
+		{"c.test", http.StatusNotFound, "Not Found"},
+	}
+	for _, test := range tests {
+		if status, body := get(test.host); status != test.status || body != test.body {
+			t.Errorf("访问域名 %s 返回 %d %q，期望 %d %q", test.host, status, body, test.status, test.body)
+		}
+	}
+
+	// 同一条连接依次发送两个域名的请求，第一个请求之后连接关闭，第二个请求不会转发给第一个域名的客户端
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:18912", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a.test\r\n\r\nGET / HTTP/1.1\r\nHost: b.test\r\n\r\n")
+	responses, _ := ioutil.ReadAll(conn)
+	if !strings.Contains(string(responses), "a:a.test") || strings.Contains(string(responses), "a:b.test") {
+		t.Errorf("长连接中的请求转发错误：%q", responses)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 按 ClientHello 中的 SNI 转发给对应的客户端，TLS 由本地服务终止，未注册的域名关闭连接
+func TestHTTPSVhost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18913,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		HTTPSPort:    18914,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 本地服务返回 TLS 握手时的服务器名称，证明 TLS 未被服务端终止
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "tls:"+r.TLS.ServerName)
+	}))
+	defer backend.Close()
+
+	proxyAddr, _ := config.ParseNetAddress("https://" + backend.Listener.Addr().String() + "?domain=s.test")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18913},
+		ProxyAddrs: []config.NetAddress{proxyAddr},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	get := func(serverName string) (string, error) {
+		httpClient := &http.Client{
+			Timeout: 3 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			},
+		}
+		response, err := httpClient.Get("https://127.0.0.1:18914/")
+		if err != nil {
+			return "", err
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		return string(body), nil
+	}
+
+	var body string
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if body, err = get("s.test"); err == nil {
+			break
+		}
+	}
+	if body != "tls:s.test" {
+		t.Fatal("按 SNI 转发失败", body, err)
+	}
+	if body, err := get("other.test"); err == nil {
+		t.Fatal("未注册的域名未被关闭", body)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 旧版协议格式：协议长度(1字节)|结果|版本号|访问端口|Key
+func legacyHandshake(t *testing.T, conn net.Conn, version uint32, port uint32, key string) (byte, uint32, uint32, string) {
+	body := make([]byte, 9, 9+len(key))
+	body[0] = 1
+	binary.BigEndian.PutUint32(body[1:5], version)
+	binary.BigEndian.PutUint32(body[5:9], port)
+	body = append(body, key...)
+	if _, err := conn.Write(append([]byte{byte(len(body))}, body...)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		t.Fatal("接收旧版握手响应失败", err)
+	}
+	response := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, response); err != nil || len(response) < 9 {
+		t.Fatal("接收旧版握手响应失败", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return response[0], binary.BigEndian.Uint32(response[1:5]), binary.BigEndian.Uint32(response[5:9]), string(response[9:])
+}
+
+// 版本1的客户端使用一个字节长度的旧版格式握手，服务端按相同格式响应并转发访问连接
+// 新版格式兼容更高的版本号，版本3的客户端仍可在握手时发送密钥
+func TestLegacyHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18915,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() net.Conn {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:18915", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	tests := []struct {
+		version uint32
+		port    uint32
+		key     string
+		result  byte
+	}{
+		{2, 18916, "Aulang", 4},
+		{1, 18916, "Other", 3},
+		{1, 30000, "Aulang", 5},
+	}
+	for _, test := range tests {
+		conn := dial()
+		result, version, port, key := legacyHandshake(t, conn, test.version, test.port, test.key)
+		_ = conn.Close()
+		if result != test.result || version != test.version || port != test.port || key != test.key {
+			t.Errorf("旧版握手 %d|%d|%s 返回 %d|%d|%d|%s，期望结果 %d", test.version, test.port, test.key, result, version, port, key, test.result)
+		}
+	}
+
+	// 握手成功的连接放入连接池，转发访问连接
+	work := dial()
+	defer work.Close()
+	if result, version, port, key := legacyHandshake(t, work, 1, 18916, "Aulang"); result != 1 || version != 1 || port != 18916 || key != "Aulang" {
+		t.Fatalf("旧版握手返回 %d|%d|%d|%s", result, version, port, key)
+	}
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18916", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_, _ = visitor.Write([]byte("ping"))
+	if body := readVisit(work, 4); body != "ping" {
+		t.Fatal("旧版客户端连接未收到访问数据", body)
+	}
+	_, _ = work.Write([]byte("pong"))
+	if body := readVisit(visitor, 4); body != "pong" {
+		t.Fatal("访问连接未收到旧版客户端数据", body)
+	}
+
+	// 版本3的新版格式，握手时发送密钥
+	control := openStream(t, dialSession(ctx, t, "127.0.0.1:18915"))
+	if result := exchange(t, control, handshake{Result: 1, Version: 3, Key: "Aulang", Capabilities: []string{"udp", "unknown"}}); result.Result != 1 || len(result.Capabilities) != 1 || result.Capabilities[0] != "udp" {
+		t.Fatal("版本3握手失败", result)
+	}
+	control = openStream(t, dialSession(ctx, t, "127.0.0.1:18915"))
+	if result := exchange(t, control, handshake{Result: 1, Version: 2, Key: "Aulang"}); result.Result != 4 {
+		t.Fatal("新版格式低于版本3时未返回版本不匹配", result)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 等待访问端口停止监听
+func waitForClosed(t *testing.T, port uint32) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}
+	t.Fatal("访问端口未关闭", port)
+}
+
+// 重新加载配置只影响修改的部分：客户端增减代理映射，服务端缩小访问端口范围，未修改的代理及进行中的连接不受影响
+func TestReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig := config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18919,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18920",
+	}
+	server := core.NewServer(serverConfig)
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 本地服务原样返回收到的数据
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	mapping := func(port uint32) config.NetAddress {
+		proxyAddr, _ := config.ParseNetAddress(fmt.Sprintf("%s:%d", backend, port))
+		return proxyAddr
+	}
+	clientConfig := config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18919},
+		ProxyAddrs: []config.NetAddress{mapping(18921), mapping(18922)},
+	}
+	client := core.NewClient(clientConfig)
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18920", 18921, 18922)
+
+	// 进行中的连接，每次重新加载之后检查仍可转发
+	active, err := net.DialTimeout("tcp", "127.0.0.1:18921", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	echo := func(payload string) {
+		if _, err := active.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if body := readVisit(active, len(payload)); body != payload {
+			t.Fatalf("进行中的连接转发失败：%q", body)
+		}
+	}
+	echo("before")
+
+	// 客户端移除一个代理并新增一个代理
+	clientConfig.ProxyAddrs = []config.NetAddress{mapping(18921), mapping(18923)}
+	if err := client.Reload(clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	waitForTunnels(t, "127.0.0.1:18920", 18923)
+	waitForClosed(t, 18922)
+	echo("client-reload")
+
+	// 服务端缩小访问端口范围，范围之外的代理端口关闭
+	serverConfig.MaxProxyPort = 18922
+	if err := server.Reload(serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	waitForClosed(t, 18923)
+	echo("server-reload")
+
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18921", time.Second)
+	if err != nil {
+		t.Fatal("未修改的代理端口已关闭", err)
+	}
+	defer visitor.Close()
+	_, _ = visitor.Write([]byte("new"))
+	if body := readVisit(visitor, 3); body != "new" {
+		t.Fatal("未修改的代理端口转发失败", body)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 测试用CA，证书及私钥写入临时目录
+type testCA struct {
+	dir  string
+	file string // CA证书文件
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// 创建CA，name 为证书文件名前缀及 CommonName
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{dir: dir, cert: cert, key: key}
+	ca.file = ca.write(t, name+"-ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// 签发同时用于服务端及客户端的证书，IP 为 127.0.0.1，返回证书及私钥文件
+func (ca *testCA) issue(t *testing.T, name string, commonName string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.write(t, name+".pem", "CERTIFICATE", der), ca.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// 写入 PEM 文件
+func (ca *testCA) write(t *testing.T, name string, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 等待服务端关闭连接，超时未关闭时失败
+func expectClosedBy(t *testing.T, conn net.Conn, timeout time.Duration, name string) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(name+"未被服务端关闭", err)
+	}
+}
+
+// 桥接连接在心跳超时时间内未完成握手时被关闭：不发送数据、只建立多路复用会话、TLS握手未开始
+func TestBridgeHandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca := newTestCA(t, t.TempDir(), "netbus")
+	certFile, keyFile := ca.issue(t, "server", "server")
+	heartbeat := config.HeartbeatConfig{Interval: 200 * time.Millisecond, Timeout: 500 * time.Millisecond}
+	var servers []*core.Server
+	for _, cfg := range []config.ServerConfig{
+		{Key: "Aulang", Port: 18924, Heartbeat: heartbeat},
+		{Key: "Aulang", Port: 18925, Heartbeat: heartbeat, TLS: config.TLSConfig{CertFile: certFile, KeyFile: keyFile}},
+	} {
+		server := core.NewServer(cfg)
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+
+	for _, addr := range []string{"127.0.0.1:18924", "127.0.0.1:18925"} {
+		idle, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectClosedBy(t, idle, 3*time.Second, "未发送数据的桥接连接 ["+addr+"] ")
+		_ = idle.Close()
+	}
+
+	// 多路复用会话中未打开数据流
+	session := dialSession(ctx, t, "127.0.0.1:18924")
+	select {
+	case <-session.CloseChan():
+	case <-time.After(3 * time.Second):
+		t.Fatal("未打开数据流的多路复用会话未被服务端关闭")
+	}
+
+	// 打开数据流但未发送协议消息
+	stream := openStream(t, dialSession(ctx, t, "127.0.0.1:18924"))
+	expectClosedBy(t, stream, 3*time.Second, "未发送协议消息的数据流")
+
+	// 完成握手的会话不受握手超时影响
+	authenticated := dialSession(ctx, t, "127.0.0.1:18924")
+	control := openStream(t, authenticated)
+	if result := exchange(t, control, handshake{Result: 1, Version: 3, Key: "Aulang"}); result.Result != 1 {
+		t.Fatal("认证失败", result)
+	}
+	time.Sleep(time.Second)
+	if authenticated.IsClosed() {
+		t.Fatal("完成握手的会话被关闭")
+	}
+
+	cancel()
+	for _, server := range servers {
+		_ = server.Wait()
+	}
+}
+
+// 等待一段时间后访问端口仍未监听，客户端未能连接服务端
+func expectNotListening(t *testing.T, port uint32, name string) {
+	time.Sleep(time.Second)
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal(name+"的访问端口已注册", port)
+	}
+}
+
+// TLS桥接连接：校验服务端证书的客户端可以转发，未启用TLS的客户端及CA不匹配的客户端无法连接
+func TestTLSBridge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "netbus")
+	other := newTestCA(t, dir, "other")
+	certFile, keyFile := ca.issue(t, "server", "server")
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18926,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18927",
+		TLS:          config.TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	startClient := func(tlsConfig config.TLSConfig, port uint32) {
+		proxyAddr, _ := config.ParseNetAddress(fmt.Sprintf("%s:%d", backend, port))
+		client := core.NewClient(config.ClientConfig{
+			Key:        "Aulang",
+			ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18926},
+			ProxyAddrs: []config.NetAddress{proxyAddr},
+			TLS:        tlsConfig,
+		})
+		if err := client.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startClient(config.TLSConfig{CAFile: ca.file}, 18928)
+	startClient(config.TLSConfig{}, 18929)
+	startClient(config.TLSConfig{CAFile: other.file}, 18930)
+
+	waitForTunnels(t, "127.0.0.1:18927", 18928)
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18928", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_, _ = visitor.Write([]byte("tls"))
+	if body := readVisit(visitor, 3); body != "tls" {
+		t.Fatal("TLS桥接连接转发失败", body)
+	}
+
+	expectNotListening(t, 18929, "未启用TLS的客户端")
+	expectNotListening(t, 18930, "CA不匹配的客户端")
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 客户端只配置证书和私钥时同样启用TLS并出示证书，证书和私钥只配置其一时报错
+func TestClientTLSConfig(t *testing.T) {
+	ca := newTestCA(t, t.TempDir(), "netbus")
+	certFile, keyFile := ca.issue(t, "client", "alice")
+
+	tests := []struct {
+		tls     config.TLSConfig
+		enabled bool
+		certs   int
+		valid   bool
+	}{
+		{config.TLSConfig{}, false, 0, true},
+		{config.TLSConfig{Enable: true}, true, 0, true},
+		{config.TLSConfig{CAFile: ca.file}, true, 0, true},
+		{config.TLSConfig{CertFile: certFile, KeyFile: keyFile}, true, 1, true},
+		{config.TLSConfig{CertFile: certFile}, true, 0, false},
+		{config.TLSConfig{KeyFile: keyFile}, true, 0, false},
+	}
+	for _, test := range tests {
+		if enabled := test.tls.ClientEnabled(); enabled != test.enabled {
+			t.Errorf("%+v 是否启用TLS：%v，应当为：%v", test.tls, enabled, test.enabled)
+		}
+		tlsConfig, err := test.tls.ClientTLSConfig("127.0.0.1")
+		if (err == nil) != test.valid {
+			t.Errorf("%+v 加载TLS配置：%v", test.tls, err)
+			continue
+		}
+		if err == nil && len(tlsConfig.Certificates) != test.certs {
+			t.Errorf("%+v 客户端证书数量：%d，应当为：%d", test.tls, len(tlsConfig.Certificates), test.certs)
+		}
+	}
+}
+
+// 证书认证：证书身份优先使用 CommonName，其次使用 SAN，按客户端凭据判断访问端口的归属
+// 其他CA签发的证书不能作为证书身份，未配置密钥的客户端认证失败
+func TestCertIdentity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "netbus")
+	other := newTestCA(t, dir, "other")
+	certFile, keyFile := ca.issue(t, "server", "server")
+	credential := func(id string, port uint32) config.ClientCredential {
+		return config.ClientCredential{ID: id, Secret: "secret", PortRanges: []config.PortRange{{Min: port, Max: port}}}
+	}
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18931,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18932",
+		TLS:          config.TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file},
+		Credentials: map[string]config.ClientCredential{
+			"alice": credential("alice", 18933),
+			"bob":   credential("bob", 18934),
+			"carol": credential("carol", 18935),
+		},
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	// 证书认证的客户端不配置密钥
+	startClient := func(issuer *testCA, name string, commonName string, dnsNames []string, port uint32) *core.Client {
+		clientCert, clientKey := issuer.issue(t, name, commonName, dnsNames...)
+		proxyAddr, _ := config.ParseNetAddress(fmt.Sprintf("%s:%d", backend, port))
+		client := core.NewClient(config.ClientConfig{
+			ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18931},
+			ProxyAddrs: []config.NetAddress{proxyAddr},
+			TLS:        config.TLSConfig{CAFile: ca.file, CertFile: clientCert, KeyFile: clientKey},
+		})
+		if err := client.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	startClient(ca, "alice", "alice", []string{"ignored"}, 18933)
+	startClient(ca, "bob", "", []string{"bob"}, 18934)
+	startClient(ca, "mallory", "mallory", nil, 18935)
+	forged := startClient(other, "forged", "carol", nil, 18936)
+
+	waitForTunnels(t, "127.0.0.1:18932", 18933, 18934)
+	for _, port := range []uint32{18933, 18934} {
+		visitor, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = visitor.Write([]byte("cert"))
+		if body := readVisit(visitor, 4); body != "cert" {
+			t.Fatal("证书认证的客户端转发失败", port, body)
+		}
+		_ = visitor.Close()
+	}
+
+	expectNotListening(t, 18935, "证书身份与客户端凭据不符的客户端")
+	expectNotListening(t, 18936, "其他CA签发证书的客户端")
+	if err := forged.Wait(); !errors.Is(err, core.ErrAuthFailed) {
+		t.Fatal("其他CA签发证书的客户端未认证失败", err)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 转发到 target 的中继，记录建立的连接数，返回监听端口
+func startRelay(ctx context.Context, t *testing.T, target string, accepted *int64) uint32 {
+	addr := startBackend(ctx, t, func(conn net.Conn) {
+		atomic.AddInt64(accepted, 1)
+		upstream, err := net.DialTimeout("tcp", target, time.Second)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	})
+	_, port, _ := net.SplitHostPort(addr)
+	relayPort, _ := strconv.Atoi(port)
+	return uint32(relayPort)
+}
+
+// 所有代理映射及访问连接复用同一条桥接连接
+func TestSessionReuse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18937,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18938",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端经中继连接服务端，中继记录桥接连接数
+	var bridgeConns int64
+	relayPort := startRelay(ctx, t, "127.0.0.1:18937", &bridgeConns)
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	var proxyAddrs []config.NetAddress
+	for _, port := range []uint32{18939, 18940} {
+		proxyAddr, _ := config.ParseNetAddress(fmt.Sprintf("%s:%d", backend, port))
+		proxyAddrs = append(proxyAddrs, proxyAddr)
+	}
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: relayPort},
+		ProxyAddrs: proxyAddrs,
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18938", 18939, 18940)
+
+	// 同时进行多个访问连接
+	var visitors []net.Conn
+	for i := 0; i < 6; i++ {
+		visitor, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", 18939+i%2), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer visitor.Close()
+		visitors = append(visitors, visitor)
+	}
+	for i, visitor := range visitors {
+		payload := fmt.Sprintf("visit-%d", i)
+		_, _ = visitor.Write([]byte(payload))
+		if body := readVisit(visitor, len(payload)); body != payload {
+			t.Fatal("访问连接转发失败", i, body)
+		}
+	}
+
+	if conns := atomic.LoadInt64(&bridgeConns); conns != 1 {
+		t.Fatal("未复用桥接连接，建立的桥接连接数：", conns)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 控制消息，同 core.Message 的 JSON 格式
+type controlMessage struct {
+	Type   byte   `json:"type"`
+	Result byte   `json:"result,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Port   uint32 `json:"port,omitempty"`
+}
+
+// 发送控制消息，格式同握手协议
+func sendMessage(t *testing.T, conn net.Conn, message controlMessage) {
+	body, _ := json.Marshal(message)
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, uint32(len(body)))
+	if _, err := conn.Write(append(head, body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 接收控制消息，timeout 内未收到时返回 false
+func receiveMessage(conn net.Conn, timeout time.Duration) (controlMessage, bool) {
+	var message controlMessage
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return message, false
+	}
+	body := make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return message, false
+	}
+	return message, json.Unmarshal(body, &message) == nil
+}
+
+// 使用超级密钥建立已认证的会话，返回会话及控制连接
+func dialControl(ctx context.Context, t *testing.T, addr string, capabilities ...string) (*yamux.Session, net.Conn) {
+	session := dialSession(ctx, t, addr)
+	control := openStream(t, session)
+	if result := exchange(t, control, handshake{Result: 1, Version: 3, Key: "Aulang", Capabilities: capabilities}); result.Result != 1 {
+		t.Fatal("控制连接认证失败", result)
+	}
+	return session, control
+}
+
+// 注册代理，返回注册结果
+func register(t *testing.T, control net.Conn, name string, port uint32) controlMessage {
+	sendMessage(t, control, controlMessage{Type: 1, Name: name, Port: port})
+	result, ok := receiveMessage(control, 3*time.Second)
+	if !ok || result.Type != 2 || result.Name != name {
+		t.Fatal("未收到注册结果", name, result)
+	}
+	return result
+}
+
+// 服务端在访问者到达时才通过控制连接请求工作连接，每个访问者请求一次，注册之后不预先建立
+func TestOnDemandWorkConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18941,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	session, control := dialControl(ctx, t, "127.0.0.1:18941")
+	if result := register(t, control, "web", 18942); result.Result != 1 || result.Port != 18942 {
+		t.Fatal("注册代理失败", result)
+	}
+	if message, ok := receiveMessage(control, 500*time.Millisecond); ok {
+		t.Fatal("没有访问者时请求了工作连接", message)
+	}
+
+	for i := 0; i < 2; i++ {
+		visitor, err := net.DialTimeout("tcp", "127.0.0.1:18942", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer visitor.Close()
+		payload := fmt.Sprintf("ping-%d", i)
+		_, _ = visitor.Write([]byte(payload))
+
+		message, ok := receiveMessage(control, 3*time.Second)
+		if !ok || message.Type != 3 || message.Port != 18942 {
+			t.Fatal("访问者到达时未请求工作连接", message)
+		}
+		// 工作连接随会话认证，不发送密钥
+		work := openStream(t, session)
+		if result := exchange(t, work, handshake{Result: 1, Version: 4, Port: 18942}); result.Result != 1 {
+			t.Fatal("工作连接握手失败", result)
+		}
+		if body := readVisit(work, len(payload)); body != payload {
+			t.Fatal("工作连接未收到访问数据", body)
+		}
+		_, _ = work.Write([]byte("pong"))
+		if body := readVisit(visitor, 4); body != "pong" {
+			t.Fatal("访问者未收到工作连接的响应", body)
+		}
+	}
+	if message, ok := receiveMessage(control, 500*time.Millisecond); ok {
+		t.Fatal("请求了多余的工作连接", message)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 服务端分配访问端口：从上次分配的端口之后开始，刚释放的端口不会立即被复用，范围内没有空闲端口时返回访问端口不合法
+func TestAutoPort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 范围不含边界，可分配 18944 ~ 18946
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18943,
+		MinProxyPort: 18943,
+		MaxProxyPort: 18947,
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, control := dialControl(ctx, t, "127.0.0.1:18943", "auto_port", "unregister")
+	assign := func(name string) uint32 {
+		result := register(t, control, name, 0)
+		if result.Result != 1 {
+			t.Fatal("分配访问端口失败", name, result)
+		}
+		return result.Port
+	}
+
+	next := func(port uint32) uint32 {
+		return 18944 + (port-18944+1)%3
+	}
+
+	first, second := assign("a"), assign("b")
+	if first < 18944 || first > 18946 || second != next(first) {
+		t.Fatal("未从上次分配的端口之后开始分配", first, second)
+	}
+	// 释放第一个端口，下一次分配跳过刚释放的端口
+	sendMessage(t, control, controlMessage{Type: 7, Name: "a", Port: first})
+	if third := assign("c"); third != next(second) {
+		t.Fatal("未按顺序分配下一个端口", first, second, third)
+	}
+	if fourth := assign("d"); fourth != first {
+		t.Fatal("轮转一周之后未分配已释放的端口", first, fourth)
+	}
+
+	if result := register(t, control, "e", 0); result.Result != 5 {
+		t.Fatal("没有空闲端口时未返回访问端口不合法", result)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 协商了心跳的客户端在心跳超时时间内未发送消息时被断开，并关闭其代理端口；按间隔发送心跳的客户端不受影响
+func TestHeartbeatTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18948,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		Heartbeat:    config.HeartbeatConfig{Interval: 200 * time.Millisecond, Timeout: 500 * time.Millisecond},
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	silent, silentControl := dialControl(ctx, t, "127.0.0.1:18948", "heartbeat")
+	if result := register(t, silentControl, "silent", 18949); result.Result != 1 {
+		t.Fatal("注册代理失败", result)
+	}
+	alive, aliveControl := dialControl(ctx, t, "127.0.0.1:18948", "heartbeat")
+	if result := register(t, aliveControl, "alive", 18950); result.Result != 1 {
+		t.Fatal("注册代理失败", result)
+	}
+
+	// 按心跳间隔发送心跳并接收响应
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		sendMessage(t, aliveControl, controlMessage{Type: 4})
+		if pong, ok := receiveMessage(aliveControl, time.Second); !ok || pong.Type != 5 {
+			t.Fatal("未收到心跳响应", pong)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	select {
+	case <-silent.CloseChan():
+	case <-time.After(3 * time.Second):
+		t.Fatal("心跳超时的客户端未被断开")
+	}
+	waitForClosed(t, 18949)
+	if alive.IsClosed() {
+		t.Fatal("按间隔发送心跳的客户端被断开")
+	}
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18950", time.Second)
+	if err != nil {
+		t.Fatal("按间隔发送心跳的客户端的代理端口已关闭", err)
+	}
+	_ = visitor.Close()
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 优雅停止：停止受理新的访问连接，等待进行中的连接完成；超过 DrainTimeout 时强制停止并返回错误
+func TestShutdownDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	// 启动服务端及客户端，返回已建立的访问连接
+	start := func(port uint32, proxyPort uint32, drainTimeout time.Duration) (*core.Server, net.Conn) {
+		server := core.NewServer(config.ServerConfig{
+			Key:          "Aulang",
+			Port:         port,
+			MinProxyPort: 10000,
+			MaxProxyPort: 20000,
+			DrainTimeout: drainTimeout,
+		})
+		if err := server.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		proxyAddr, _ := config.ParseNetAddress(fmt.Sprintf("%s:%d", backend, proxyPort))
+		client := core.NewClient(config.ClientConfig{
+			Key:        "Aulang",
+			ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: port},
+			ProxyAddrs: []config.NetAddress{proxyAddr},
+		})
+		if err := client.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			visitor, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort), time.Second)
+			if err != nil {
+				continue
+			}
+			_, _ = visitor.Write([]byte("start"))
+			if body := readVisit(visitor, 5); body == "start" {
+				return server, visitor
+			}
+			_ = visitor.Close()
+		}
+		t.Fatal("访问端口未注册", proxyPort)
+		return nil, nil
+	}
+	shutdown := func(server *core.Server) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- server.Shutdown(context.Background())
+		}()
+		return result
+	}
+
+	// 进行中的连接完成之后停止
+	server, visitor := start(18951, 18952, 5*time.Second)
+	stopped := shutdown(server)
+	time.Sleep(300 * time.Millisecond)
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:18952", time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("停止过程中仍受理新的访问连接")
+	}
+	_, _ = visitor.Write([]byte("drain"))
+	if body := readVisit(visitor, 5); body != "drain" {
+		t.Fatal("停止过程中进行中的连接被中断", body)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatal("进行中的连接未完成时已停止", err)
+	default:
+	}
+	_ = visitor.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("进行中的连接完成之后未停止")
+	}
+
+	// 超过 DrainTimeout 时强制停止，断开进行中的连接
+	server, visitor = start(18953, 18954, 500*time.Millisecond)
+	defer visitor.Close()
+	begin := time.Now()
+	select {
+	case err := <-shutdown(server):
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("等待超时时未返回错误", err)
+		}
+		if elapsed := time.Since(begin); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatal("未按 DrainTimeout 等待", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("超过 DrainTimeout 之后未停止")
+	}
+	expectClosedBy(t, visitor, 3*time.Second, "强制停止时进行中的连接")
+}
+
+// 代理限速：突发之外的流量按配置的速率转发
+func TestBandwidthLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18955,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		AdminAddr:    "127.0.0.1:18957",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 本地服务返回 1MB + 256KB 之后关闭，突发 256KB 之外的 1MB 按每秒 1MB 转发，约 1 秒
+	const size = 1<<20 + 256<<10
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = conn.Write(make([]byte, size))
+		_ = conn.Close()
+	})
+	proxyAddr, _ := config.ParseNetAddress(backend + ":18956?rate=1MB&burst=256KB")
+	client := core.NewClient(config.ClientConfig{
+		Key:        "Aulang",
+		ServerAddr: config.NetAddress{Host: "127.0.0.1", Port: 18955},
+		ProxyAddrs: []config.NetAddress{proxyAddr},
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18957", 18956)
+
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18956", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_ = visitor.SetDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	received, _ := io.Copy(ioutil.Discard, visitor)
+	elapsed := time.Since(start)
+	if received != size {
+		t.Fatal("接收的字节数不对", received)
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("限速之后的转发耗时超出误差范围", elapsed)
+	}
+
+	cancel()
+	_ = server.Wait()
+}
+
+// 字节数格式：支持 K、M、G 单位及小数，非数字、负数及超出范围的值格式不对
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		str   string
+		size  int64
+		valid bool
+	}{
+		{"", 0, true},
+		{"512", 512, true},
+		{"512K", 512 << 10, true},
+		{"1.5mb", 3 << 19, true},
+		{" 2 G ", 2 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"-1", 0, false},
+		{"abc", 0, false},
+		{"nan", 0, false},
+		{"NaNk", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"-infm", 0, false},
+		{"1e30g", 0, false},
+		{"8589934592G", 0, false},
+		{"9223372036854775808", 0, false},
+	}
+	for _, test := range tests {
+		size, err := config.ParseByteSize(test.str)
+		if (err == nil) != test.valid || size != test.size {
+			t.Errorf("%q 解析为：%d，%v，应当为：%d，有效：%v", test.str, size, err, test.size, test.valid)
+		}
+	}
+}
+
+// 读取监控指标
+func readMetrics(t *testing.T, addr string) string {
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	return string(body)
+}
+
+// 负载均衡组成员及域名代理的指标不使用虚拟端口：组成员按组的访问端口输出，域名代理服务端按共享端口、客户端按访问域名输出
+func TestTunnelMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := core.NewServer(config.ServerConfig{
+		Key:          "Aulang",
+		Port:         18958,
+		MinProxyPort: 10000,
+		MaxProxyPort: 20000,
+		HTTPPort:     18959,
+		AdminAddr:    "127.0.0.1:18960",
+		MetricsAddr:  "127.0.0.1:18961",
+	})
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := startBackend(ctx, t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	groupAddr, _ := config.ParseNetAddress(backend + ":18963?group=web")
+	domainAddr, _ := config.ParseNetAddress("http://" + startHTTPBackend(ctx, t, "m") + "?domain=m.test")
+	client := core.NewClient(config.ClientConfig{
+		Key:         "Aulang",
+		ServerAddr:  config.NetAddress{Host: "127.0.0.1", Port: 18958},
+		ProxyAddrs:  []config.NetAddress{groupAddr, domainAddr},
+		MetricsAddr: "127.0.0.1:18962",
+	})
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitForTunnels(t, "127.0.0.1:18960", 18963, 18959)
+
+	// 访问之后客户端才有该代理的统计
+	visitor, err := net.DialTimeout("tcp", "127.0.0.1:18963", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_, _ = visitor.Write([]byte("group"))
+	if body := readVisit(visitor, 5); body != "group" {
+		t.Fatal("负载均衡组转发失败", body)
+	}
+	request, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:18959/", nil)
+	request.Host = "m.test"
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+
+	portLabel := regexp.MustCompile(`port="(\d+)"`)
+	for name, expected := range map[string][]string{
+		"127.0.0.1:18961": {`netbus_tunnel_active_connections{port="18963",type="tcp"} 1`, `netbus_tunnel_active_connections{port="18959",type="http"}`},
+		"127.0.0.1:18962": {`netbus_tunnel_active_connections{port="18963",type="tcp"} 1`, `netbus_tunnel_active_connections{domain="m.test",type="http"}`},
+	} {
+		body := readMetrics(t, name)
+		for _, sample := range expected {
+			if !strings.Contains(body, sample) {
+				t.Errorf("监控指标 %s 缺少：%s\n%s", name, sample, body)
+			}
+		}
+		for _, match := range portLabel.FindAllStringSubmatch(body, -1) {
+			if port, _ := strconv.Atoi(match[1]); port > 65535 {
+				t.Errorf("监控指标 %s 使用了虚拟端口：%s", name, match[0])
+			}
+		}
+	}
+
+	cancel()
+	_ = server.Wait()
 }